@@ -0,0 +1,235 @@
+package tearpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+访问日志, 用于审计:
+1、每个处理完的请求(包括被拒绝的请求)写一条记录, 在 handleRequest 回复之后和 serveCodec 拒绝请求之后产生
+2、SampleRate 在 (0, 1) 之间时只按比例记录成功的请求, 失败的请求总是记录
+3、Args 为 true 时记录参数: 先转成 json, 再把 Redact 里列出的字段替换成 "[REDACTED]".
+   字段名不区分大小写, "Password" 匹配任意层级的 Password 字段, "Card.Number" 只匹配这个路径
+*/
+
+// AccessRecord describes one completed request.
+type AccessRecord struct {
+	Time         time.Time // 开始处理请求的时间
+	Peer         string
+	Identity     string `json:",omitempty"`
+	ServerMethod string
+	Seq          uint64
+	Duration     time.Duration
+	// 请求和响应在连接上占的字节数(header + body), 不知道时为 0
+	RequestSize  int64
+	ResponseSize int64
+	Code         Code
+	Status       string // Code 的名字
+	Error        string `json:",omitempty"`
+	// Args 是脱敏之后的参数, 只有 AccessLog.Args 为 true 时才有
+	Args interface{} `json:",omitempty"`
+}
+
+// AccessSink receives access records. It is called from the goroutines
+// serving calls, so it must be safe for concurrent use.
+type AccessSink interface {
+	WriteAccess(rec *AccessRecord)
+}
+
+// AccessSinkFunc adapts a function to an AccessSink.
+type AccessSinkFunc func(rec *AccessRecord)
+
+func (f AccessSinkFunc) WriteAccess(rec *AccessRecord) { f(rec) }
+
+// AccessLog configures the access log of a Server.
+type AccessLog struct {
+	Sink AccessSink
+	// SampleRate 在 (0, 1) 之间时按比例采样, 其他值记录全部请求. 出错的请求总是记录
+	SampleRate float64
+	// Args 为 true 时记录采样的请求的参数
+	Args bool
+	// Redact 列出需要脱敏的参数字段
+	Redact []string
+
+	redact redactor
+}
+
+const redactedValue = "[REDACTED]"
+
+// accessEntry 是一个请求在访问日志里的状态, 在方法开始执行之前创建. log 为空表示不写访问日志
+type accessEntry struct {
+	log     *AccessLog
+	sampled bool
+	args    interface{}
+}
+
+// begin 先决定是否采样, 只有采样的请求才记录参数. 要在方法开始执行之前调用, 方法可能会修改参数.
+// 没有采样的请求出错时仍然会记录, 但是不带参数
+func (l *AccessLog) begin(argv reflect.Value) accessEntry {
+	if l == nil || l.Sink == nil {
+		return accessEntry{}
+	}
+	e := accessEntry{log: l, sampled: l.SampleRate <= 0 || l.SampleRate >= 1 || rand.Float64() < l.SampleRate}
+	if e.sampled {
+		e.args = l.args(argv)
+	}
+	return e
+}
+
+// args 返回脱敏后的参数
+func (l *AccessLog) args(argv reflect.Value) interface{} {
+	if !l.Args || !argv.IsValid() {
+		return nil
+	}
+	v, err := l.redact.apply(l.Redact, argv.Interface())
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// redactor 按字段名脱敏, 访问日志和录制共用. 字段列表在第一次使用时转成小写的集合
+type redactor struct {
+	once  sync.Once
+	names map[string]bool
+}
+
+// apply 把 v 转成 json 的通用形式, 再把 list 里列出的字段替换成 "[REDACTED]"
+func (r *redactor) apply(list []string, v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // 保持数字原样, 不要变成 float64
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return nil, err
+	}
+	r.once.Do(func() {
+		r.names = make(map[string]bool, len(list))
+		for _, name := range list {
+			r.names[strings.ToLower(name)] = true
+		}
+	})
+	return redactValue(x, "", r.names), nil
+}
+
+func redactValue(v interface{}, path string, names map[string]bool) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if names[strings.ToLower(k)] || names[strings.ToLower(p)] {
+				x[k] = redactedValue
+				continue
+			}
+			x[k] = redactValue(e, p, names)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = redactValue(e, path, names)
+		}
+	}
+	return v
+}
+
+// record 写出采样的请求和所有出错的请求, start 是开始计时的时间
+func (e *accessEntry) record(h *codec.Header, peer *Peer, start time.Time, reqSize, respSize int64, err error) {
+	if e.log == nil || (!e.sampled && err == nil) {
+		return
+	}
+	rec := &AccessRecord{
+		Time:         start,
+		ServerMethod: h.ServerMethod,
+		Seq:          h.Seq,
+		Duration:     time.Since(start),
+		RequestSize:  reqSize,
+		ResponseSize: respSize,
+		Code:         Code(h.Code),
+		Status:       Code(h.Code).String(),
+		Error:        h.Error,
+		Args:         e.args,
+	}
+	if peer != nil {
+		if peer.Addr != nil {
+			rec.Peer = peer.Addr.String()
+		}
+		rec.Identity = peer.Identity
+	}
+	e.log.Sink.WriteAccess(rec)
+}
+
+// JSONAccessSink writes each record as one line of JSON.
+type JSONAccessSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+func NewJSONAccessSink(w io.Writer) *JSONAccessSink {
+	return &JSONAccessSink{enc: json.NewEncoder(w)}
+}
+
+// NewJSONAccessFileSink appends records to the file at path, creating it if
+// needed. Close the sink to close the file.
+func NewJSONAccessFileSink(path string) (*JSONAccessSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := NewJSONAccessSink(f)
+	s.closer = f
+	return s, nil
+}
+
+func (s *JSONAccessSink) WriteAccess(rec *AccessRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(rec)
+}
+
+func (s *JSONAccessSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// SlogAccessSink writes each record as an Info message of logger.
+func SlogAccessSink(logger *slog.Logger) AccessSink {
+	return AccessSinkFunc(func(rec *AccessRecord) {
+		attrs := []slog.Attr{
+			slog.Time("time", rec.Time),
+			slog.String("peer", rec.Peer),
+			slog.String("identity", rec.Identity),
+			slog.String("method", rec.ServerMethod),
+			slog.Uint64("seq", rec.Seq),
+			slog.Duration("duration", rec.Duration),
+			slog.Int64("request_size", rec.RequestSize),
+			slog.Int64("response_size", rec.ResponseSize),
+			slog.String("status", rec.Status),
+		}
+		if rec.Error != "" {
+			attrs = append(attrs, slog.String("err", rec.Error))
+		}
+		if rec.Args != nil {
+			attrs = append(attrs, slog.Any("args", rec.Args))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "rpc access", attrs...)
+	})
+}
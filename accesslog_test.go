@@ -0,0 +1,109 @@
+package tearpc
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type LoginArgs struct {
+	User     string
+	Password string
+	Card     struct{ Number, Holder string }
+}
+
+type Account struct{}
+
+func (Account) Login(args LoginArgs, reply *string) error {
+	if args.Password != "secret" {
+		return Errorf(Unauthenticated, "wrong password")
+	}
+	*reply = "welcome " + args.User
+	return nil
+}
+
+type accessRecords struct {
+	mu   sync.Mutex
+	recs []AccessRecord
+}
+
+func (r *accessRecords) WriteAccess(rec *AccessRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs = append(r.recs, *rec)
+}
+
+// wait 记录在回复之后才写, 等到有 n 条为止
+func (r *accessRecords) wait(n int) []AccessRecord {
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		recs := append([]AccessRecord(nil), r.recs...)
+		r.mu.Unlock()
+		if len(recs) >= n || time.Now().After(deadline) {
+			return recs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	records := &accessRecords{}
+	server := NewServer()
+	_ = server.Register(Account{})
+	server.Authenticator = NewTokenAuth(map[string]string{"t0k3n": "alice"})
+	server.AccessLog = &AccessLog{Sink: records, Args: true, Redact: []string{"password", "Card.Number"}}
+	opt := *DefaultOption
+	opt.Credentials = TokenCredentials("t0k3n")
+	client, cleanup := dialTestServer(server, &opt)
+	defer cleanup()
+
+	args := LoginArgs{User: "alice", Password: "secret"}
+	args.Card.Number, args.Card.Holder = "4242", "Alice"
+	var reply string
+	err := client.Call(context.Background(), "Account.Login", args, &reply)
+	_assert(err == nil && reply == "welcome alice", "call failed: %q %v", reply, err)
+	args.Password = "guess"
+	err = client.Call(context.Background(), "Account.Login", args, &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+	err = client.Call(context.Background(), "Account.Logout", args, &reply)
+	_assert(CodeOf(err) == NotFound, "expect NotFound, got %v", err)
+
+	recs := records.wait(3)
+	_assert(len(recs) == 3, "expect 3 records, got %+v", recs)
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Seq < recs[j].Seq }) // 记录在回复之后才写, 顺序不确定
+	ok, failed, rejected := recs[0], recs[1], recs[2]
+	for _, r := range recs {
+		_assert(r.Peer != "" && r.Identity == "alice" && r.RequestSize > 0 && r.ResponseSize > 0 && !r.Time.IsZero(),
+			"unexpected record %+v", r)
+	}
+	_assert(ok.ServerMethod == "Account.Login" && ok.Code == OK && ok.Status == "OK" && ok.Error == "", "unexpected record %+v", ok)
+	_assert(failed.Seq > ok.Seq && failed.Code == Unauthenticated && failed.Error != "", "unexpected record %+v", failed)
+	_assert(rejected.ServerMethod == "Account.Logout" && rejected.Code == NotFound, "unexpected record %+v", rejected)
+
+	data, _ := json.Marshal(ok.Args)
+	want := `{"Card":{"Holder":"Alice","Number":"[REDACTED]"},"Password":"[REDACTED]","User":"alice"}`
+	_assert(string(data) == want, "expect args %s, got %s", want, data)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	records := &accessRecords{}
+	server := NewServer()
+	_ = server.Register(Account{})
+	server.AccessLog = &AccessLog{Sink: records, SampleRate: 0.000001, Args: true}
+	client, cleanup := dialTestServer(server)
+	defer cleanup()
+
+	var reply string
+	for i := 0; i < 20; i++ {
+		_ = client.Call(context.Background(), "Account.Login", LoginArgs{Password: "secret"}, &reply)
+	}
+	// 失败的请求总是记录, 没有采样的不带参数
+	err := client.Call(context.Background(), "Account.Login", LoginArgs{}, &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+	recs := records.wait(1)
+	_assert(len(recs) == 1 && recs[0].Code == Unauthenticated && recs[0].Args == nil, "expect only the failed call, got %+v", recs)
+}
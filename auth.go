@@ -0,0 +1,313 @@
+package tearpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+认证和鉴权
+1、握手的时候: 客户端把 Option.Credentials 生成的凭证放在 Option.Auth 里发给服务端,
+   服务端调用 Authenticator 得到连接的身份(identity)
+2、每次调用: 客户端把凭证放在 Header.Meta 里, 服务端再调用一次 Authenticator,
+   然后用 Authorizer 检查这个身份能不能调用 "Service.Method"
+任何一步失败, 请求都会得到 PermissionDenied, 不会进入 service.call
+*/
+
+// Credentials produce the metadata a client attaches to authenticate itself.
+type Credentials interface {
+	// HandshakeMetadata is sent once, together with the Option.
+	HandshakeMetadata() (map[string]string, error)
+	// CallMetadata is attached to the header of every call.
+	CallMetadata(serviceMethod string, seq uint64) (map[string]string, error)
+}
+
+// AuthInfo is what an Authenticator gets to decide who the caller is.
+// ServerMethod is empty when authenticating the handshake.
+type AuthInfo struct {
+	Peer         *Peer
+	ServerMethod string
+	Seq          uint64
+	Metadata     map[string]string
+}
+
+// Authenticator checks the credentials of a handshake or a call and returns
+// the identity of the caller. It is evaluated on the handshake and again on
+// every call, where info.Peer.Identity holds the identity established by
+// the handshake (or by a verified client certificate).
+type Authenticator interface {
+	Authenticate(info *AuthInfo) (identity string, err error)
+}
+
+// Authorizer decides whether identity may call serviceMethod.
+type Authorizer interface {
+	Authorize(identity, serviceMethod string) error
+}
+
+const (
+	MetaAuthorization = "authorization"
+	MetaKeyID         = "x-tearpc-key-id"
+	MetaTimestamp     = "x-tearpc-timestamp"
+	MetaSignature     = "x-tearpc-signature"
+	MetaNonce         = "x-tearpc-nonce"
+)
+
+func permissionDenied(format string, a ...interface{}) error {
+	return Errorf(PermissionDenied, "rpc server: "+format, a...)
+}
+
+// 调用时没有带凭证, 沿用握手时得到的身份
+func inheritIdentity(info *AuthInfo) (string, error) {
+	if info.ServerMethod != "" && info.Peer != nil && info.Peer.Identity != "" {
+		return info.Peer.Identity, nil
+	}
+	return "", permissionDenied("missing credentials")
+}
+
+// TokenAuth authenticates bearer tokens, mapping each token to an identity.
+// Tokens may be added and removed at runtime.
+type TokenAuth struct {
+	mu     sync.RWMutex
+	tokens map[string]string // token -> identity
+}
+
+func NewTokenAuth(tokens map[string]string) *TokenAuth {
+	a := &TokenAuth{tokens: make(map[string]string)}
+	for token, identity := range tokens {
+		a.tokens[token] = identity
+	}
+	return a
+}
+
+func (a *TokenAuth) AddToken(token, identity string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens[token] = identity
+}
+
+func (a *TokenAuth) RemoveToken(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, token)
+}
+
+func (a *TokenAuth) Authenticate(info *AuthInfo) (string, error) {
+	auth, ok := info.Metadata[MetaAuthorization]
+	if !ok {
+		return inheritIdentity(info)
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for t, identity := range a.tokens { // 逐个做常量时间比较, 避免时序攻击
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+	return "", permissionDenied("invalid token")
+}
+
+type tokenCredentials string
+
+// TokenCredentials sends token as a bearer token when connecting.
+func TokenCredentials(token string) Credentials { return tokenCredentials(token) }
+
+func (t tokenCredentials) HandshakeMetadata() (map[string]string, error) {
+	return map[string]string{MetaAuthorization: "Bearer " + string(t)}, nil
+}
+
+// 握手时已经认证过了, 调用时不需要再发送
+func (t tokenCredentials) CallMetadata(string, uint64) (map[string]string, error) { return nil, nil }
+
+// HMACAuth authenticates callers that prove they hold a shared secret. The
+// key id is the identity of the caller. Each handshake and call carries an
+// HMAC of the method, the sequence number, a random nonce and a timestamp,
+// which must be within MaxSkew of the server clock. Each MAC is accepted
+// once: replays within MaxSkew are denied, so MaxSkew also bounds the memory
+// of the replay cache. With MaxSkew <= 0 there is no replay protection.
+//
+// The MAC does not cover the arguments or the other metadata of a call, so
+// it authenticates the caller, not the request: anyone on the path can change
+// them. Use TLS when they must not be tampered with.
+type HMACAuth struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte // key id -> secret
+	MaxSkew time.Duration
+
+	seenMu sync.Mutex
+	seen   map[string]int64 // 用过的签名 -> 过期时间(unix nano), 用来拒绝重放
+	sweep  int              // seen 超过这个大小时清理一次过期的签名
+}
+
+func NewHMACAuth(keys map[string][]byte) *HMACAuth {
+	a := &HMACAuth{keys: make(map[string][]byte), MaxSkew: 5 * time.Minute, seen: make(map[string]int64)}
+	for id, secret := range keys {
+		a.keys[id] = secret
+	}
+	return a
+}
+
+func (a *HMACAuth) AddKey(id string, secret []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[id] = secret
+}
+
+func (a *HMACAuth) RemoveKey(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.keys, id)
+}
+
+func (a *HMACAuth) Authenticate(info *AuthInfo) (string, error) {
+	id, ok := info.Metadata[MetaKeyID]
+	if !ok {
+		return "", permissionDenied("missing signature")
+	}
+	a.mu.RLock()
+	secret, ok := a.keys[id]
+	a.mu.RUnlock()
+	if !ok {
+		return "", permissionDenied("unknown key %q", id)
+	}
+	ts, err := strconv.ParseInt(info.Metadata[MetaTimestamp], 10, 64)
+	if err != nil {
+		return "", permissionDenied("bad timestamp")
+	}
+	if skew := time.Since(time.Unix(0, ts)); a.MaxSkew > 0 && (skew > a.MaxSkew || skew < -a.MaxSkew) {
+		return "", permissionDenied("timestamp out of range")
+	}
+	sig, err := hex.DecodeString(info.Metadata[MetaSignature])
+	nonce := info.Metadata[MetaNonce]
+	if err != nil || nonce == "" || !hmac.Equal(sig, callerMAC(secret, info.ServerMethod, info.Seq, ts, nonce)) {
+		return "", permissionDenied("bad signature")
+	}
+	if a.MaxSkew > 0 && !a.firstUse(id+"\n"+string(sig), ts+int64(a.MaxSkew)) {
+		return "", permissionDenied("replayed signature")
+	}
+	return id, nil
+}
+
+// firstUse 记录一个签名, 签名之前用过时返回 false. 过了 expires 时间戳就超出 MaxSkew 了,
+// 不需要再记住这个签名
+func (a *HMACAuth) firstUse(sig string, expires int64) bool {
+	now := time.Now().UnixNano()
+	a.seenMu.Lock()
+	defer a.seenMu.Unlock()
+	if a.seen == nil {
+		a.seen = make(map[string]int64)
+	}
+	if exp, ok := a.seen[sig]; ok && exp >= now {
+		return false
+	}
+	if len(a.seen) >= a.sweep { // 按大小翻倍触发清理, 均摊下来每次记录是常数时间
+		for s, exp := range a.seen {
+			if exp < now {
+				delete(a.seen, s)
+			}
+		}
+		a.sweep = 2*len(a.seen) + 1024
+	}
+	a.seen[sig] = expires
+	return true
+}
+
+// MAC 的内容: method \n seq \n timestamp \n nonce, 握手时 method 为空. 不包括参数和其他元数据.
+// nonce 每次随机生成, 不同连接上相同的 seq 和时间戳也不会得到相同的 MAC
+func callerMAC(secret []byte, serviceMethod string, seq uint64, ts int64, nonce string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(serviceMethod + "\n" + strconv.FormatUint(seq, 10) + "\n" + strconv.FormatInt(ts, 10) + "\n" + nonce))
+	return mac.Sum(nil)
+}
+
+type hmacCredentials struct {
+	id     string
+	secret []byte
+}
+
+// HMACCredentials authenticates the handshake and every call with an HMAC
+// keyed by secret; see HMACAuth for what it covers.
+func HMACCredentials(keyID string, secret []byte) Credentials {
+	return &hmacCredentials{id: keyID, secret: secret}
+}
+
+func (c *hmacCredentials) sign(serviceMethod string, seq uint64) (map[string]string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b[:])
+	ts := time.Now().UnixNano()
+	return map[string]string{
+		MetaKeyID:     c.id,
+		MetaTimestamp: strconv.FormatInt(ts, 10),
+		MetaNonce:     nonce,
+		MetaSignature: hex.EncodeToString(callerMAC(c.secret, serviceMethod, seq, ts, nonce)),
+	}, nil
+}
+
+func (c *hmacCredentials) HandshakeMetadata() (map[string]string, error) {
+	return c.sign("", 0)
+}
+
+func (c *hmacCredentials) CallMetadata(serviceMethod string, seq uint64) (map[string]string, error) {
+	return c.sign(serviceMethod, seq)
+}
+
+// ACL is an Authorizer made of allow rules. Everything not allowed is denied.
+type ACL struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+type aclRule struct {
+	identity string // "*" 表示任意已认证的身份
+	pattern  string // "*", "Service.*" 或者 "Service.Method"
+}
+
+func NewACL() *ACL { return &ACL{} }
+
+// Allow lets identity call the methods matching pattern, which is either
+// "*", "Service.*" or "Service.Method"; any other pattern only matches a
+// method of exactly that name. The identity "*" matches any authenticated
+// caller.
+func (a *ACL) Allow(identity, pattern string) *ACL {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = append(a.rules, aclRule{identity: identity, pattern: pattern})
+	return a
+}
+
+func (a *ACL) Authorize(identity, serviceMethod string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if r.identity == "*" && identity == "" {
+			continue
+		}
+		if (r.identity == "*" || r.identity == identity) && matchMethod(r.pattern, serviceMethod) {
+			return nil
+		}
+	}
+	return permissionDenied("%q is not allowed to call %s", identity, serviceMethod)
+}
+
+// "Service.*" 只匹配 Service 自己的方法, 不能按前缀匹配, 否则 "Foo.*" 也会匹配到 "FooAdmin.Delete"
+func matchMethod(pattern, serviceMethod string) bool {
+	if pattern == "*" || pattern == serviceMethod {
+		return true
+	}
+	svc, ok := strings.CutSuffix(pattern, ".*")
+	if !ok {
+		return false
+	}
+	dot := strings.LastIndex(serviceMethod, ".")
+	return dot >= 0 && serviceMethod[:dot] == svc
+}
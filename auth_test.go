@@ -0,0 +1,137 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthTestServer() *Server {
+	s := NewServer()
+	var foo Foo
+	var w Whoami
+	_ = s.Register(&foo)
+	_ = s.Register(&w)
+	return s
+}
+
+func TestServer_TokenAuth(t *testing.T) {
+	s := newAuthTestServer()
+	s.Authenticator = NewTokenAuth(map[string]string{"secret-token": "alice"})
+	s.Authorizer = NewACL().Allow("alice", "Whoami.*")
+
+	client, done := dialTestServer(s, &Option{Credentials: TokenCredentials("secret-token")})
+	defer done()
+	var name string
+	err := client.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(err == nil && name == "alice", "expect alice, got %q, %v", name, err)
+
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", Args{1, 2}, &sum)
+	_assert(errors.Is(err, PermissionDenied), "alice may not call Foo.Sum, got %v", err)
+
+	bad, done2 := dialTestServer(s, &Option{Credentials: TokenCredentials("wrong")})
+	defer done2()
+	err = bad.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(errors.Is(err, PermissionDenied), "wrong token should be denied, got %v", err)
+	err = bad.Call(context.Background(), "Whoami.Nope", 0, &name)
+	_assert(errors.Is(err, PermissionDenied), "unauthenticated callers must not learn about methods, got %v", err)
+}
+
+func TestServer_HMACAuth(t *testing.T) {
+	s := newAuthTestServer()
+	s.Authenticator = NewHMACAuth(map[string][]byte{"svc-b": []byte("k3y")})
+
+	client, done := dialTestServer(s, &Option{Credentials: HMACCredentials("svc-b", []byte("k3y"))})
+	defer done()
+	var name string
+	err := client.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(err == nil && name == "svc-b", "expect svc-b, got %q, %v", name, err)
+
+	forged, done2 := dialTestServer(s, &Option{Credentials: HMACCredentials("svc-b", []byte("guess"))})
+	defer done2()
+	err = forged.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(errors.Is(err, PermissionDenied), "bad signature should be denied, got %v", err)
+
+	anonymous, done3 := dialTestServer(s)
+	defer done3()
+	err = anonymous.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(errors.Is(err, PermissionDenied), "missing signature should be denied, got %v", err)
+}
+
+// fixedHandshake 每次握手都发送同一份凭证, 模拟截获后重放
+type fixedHandshake struct {
+	Credentials
+	handshake map[string]string
+}
+
+func (f fixedHandshake) HandshakeMetadata() (map[string]string, error) { return f.handshake, nil }
+
+func TestHMACAuth_Replay(t *testing.T) {
+	auth := NewHMACAuth(map[string][]byte{"svc-b": []byte("k3y")})
+	creds := HMACCredentials("svc-b", []byte("k3y"))
+	meta, err := creds.CallMetadata("Whoami.Name", 1)
+	_assert(err == nil, "sign failed: %v", err)
+	info := &AuthInfo{ServerMethod: "Whoami.Name", Seq: 1, Metadata: meta}
+	id, err := auth.Authenticate(info)
+	_assert(err == nil && id == "svc-b", "expect svc-b, got %q, %v", id, err)
+	_, err = auth.Authenticate(info)
+	_assert(errors.Is(err, PermissionDenied) && strings.Contains(err.Error(), "replayed"), "replay should be denied, got %v", err)
+
+	// 同样的 seq 和时间戳, 换一个 nonce 签名就对不上了
+	tampered := map[string]string{}
+	for k, v := range meta {
+		tampered[k] = v
+	}
+	tampered[MetaNonce] = "00"
+	_, err = auth.Authenticate(&AuthInfo{ServerMethod: "Whoami.Name", Seq: 1, Metadata: tampered})
+	_assert(errors.Is(err, PermissionDenied) && strings.Contains(err.Error(), "bad signature"), "tampered nonce should be denied, got %v", err)
+
+	// 握手的签名不能在新的连接上再用一次
+	s := newAuthTestServer()
+	s.Authenticator = auth
+	handshake, err := creds.HandshakeMetadata()
+	_assert(err == nil, "sign failed: %v", err)
+	client, done := dialTestServer(s, &Option{Credentials: fixedHandshake{creds, handshake}})
+	defer done()
+	var name string
+	err = client.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(err == nil && name == "svc-b", "expect svc-b, got %q, %v", name, err)
+	replayed, done2 := dialTestServer(s, &Option{Credentials: fixedHandshake{creds, handshake}})
+	defer done2()
+	err = replayed.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(errors.Is(err, PermissionDenied) && strings.Contains(err.Error(), "replayed"), "replayed handshake should be denied, got %v", err)
+}
+
+func TestACL(t *testing.T) {
+	acl := NewACL().Allow("*", "Foo.Sum").Allow("admin", "*")
+	_assert(acl.Authorize("bob", "Foo.Sum") == nil, "any identity may call Foo.Sum")
+	_assert(acl.Authorize("", "Foo.Sum") != nil, "anonymous callers are not matched by *")
+	_assert(acl.Authorize("bob", "Foo.Other") != nil, "bob may not call Foo.Other")
+	_assert(acl.Authorize("admin", "Bar.Baz") == nil, "admin may call anything")
+
+	// 按服务匹配, 不是按前缀
+	acl = NewACL().Allow("bob", "Foo.*").Allow("bob", "Bar*").Allow("bob", "tearpc.Reflection.*")
+	_assert(acl.Authorize("bob", "Foo.Sum") == nil, "bob may call the methods of Foo")
+	_assert(acl.Authorize("bob", "FooAdmin.Delete") != nil, "Foo.* must not match FooAdmin")
+	_assert(acl.Authorize("bob", "Bar.Baz") != nil, "Bar* is not a pattern")
+	_assert(acl.Authorize("bob", "tearpc.Reflection.List") == nil, "service names may contain dots")
+}
+
+func TestServer_UnauthenticatedPingsIgnored(t *testing.T) {
+	s := newAuthTestServer()
+	s.Authenticator = NewTokenAuth(map[string]string{"s3cret": "alice"})
+	s.IdleTimeout = 100 * time.Millisecond
+
+	// 客户端自己的心跳超时很长, 连接只会被服务端的 IdleTimeout 关闭
+	opt := &Option{Credentials: TokenCredentials("wrong"), HeartbeatInterval: 20 * time.Millisecond, HeartbeatTimeout: time.Minute}
+	client, done := dialTestServer(s, opt)
+	defer done()
+	select {
+	case <-client.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pings kept an unauthenticated connection open")
+	}
+}
@@ -0,0 +1,109 @@
+// Package benchmark measures tearpc calls across codecs, payload sizes,
+// concurrency levels and transports:
+//
+//	go test -bench . -benchmem ./benchmark
+//	go test -bench 'Call/tcp/gob/1KiB' ./benchmark
+//
+// It also provides the echo service and the servers used by the
+// tearpc-bench load generator.
+package benchmark
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"tearpc"
+)
+
+// Payload is the argument and reply of Echo.Echo.
+type Payload struct {
+	Seq  int
+	Data []byte
+}
+
+// NewPayload returns a payload carrying size bytes of data.
+func NewPayload(size int) Payload {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return Payload{Data: data}
+}
+
+// Echo replies with its argument, so a call costs only the framework.
+type Echo struct{}
+
+func (Echo) Echo(args Payload, reply *Payload) error {
+	*reply = args
+	return nil
+}
+
+// Transports are the transports StartServer supports.
+var Transports = []string{"tcp", "unix", "http", "pipe"}
+
+// StartServer serves s on transport and returns the address to pass to
+// tearpc.XDial, e.g. "tcp@127.0.0.1:34567", and a function stopping the
+// server. Unix sockets are created in a temporary directory.
+func StartServer(s *tearpc.Server, transport string) (addr string, stop func(), err error) {
+	switch transport {
+	case "tcp", "http":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", nil, err
+		}
+		addr := transport + "@" + l.Addr().String()
+		if transport == "tcp" {
+			go s.Accept(l)
+			return addr, func() { _ = l.Close() }, nil
+		}
+		hs := &http.Server{Handler: s} // 任何路径的 CONNECT 都交给 s
+		go func() { _ = hs.Serve(l) }()
+		return addr, func() { _ = hs.Close() }, nil
+	case "unix":
+		dir, err := os.MkdirTemp("", "tearpc-bench")
+		if err != nil {
+			return "", nil, err
+		}
+		path := filepath.Join(dir, "tearpc.sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", nil, err
+		}
+		go s.Accept(l)
+		return "unix@" + path, func() {
+			_ = l.Close()
+			_ = os.RemoveAll(dir)
+		}, nil
+	case tearpc.PipeNetwork:
+		l, err := tearpc.ListenPipe("")
+		if err != nil {
+			return "", nil, err
+		}
+		go s.Accept(l)
+		return "pipe@" + l.Addr().String(), func() { _ = l.Close() }, nil
+	}
+	return "", nil, fmt.Errorf("benchmark: unknown transport %q", transport)
+}
+
+// NewServer returns a server with the Echo service registered.
+func NewServer() *tearpc.Server {
+	s := tearpc.NewServer()
+	if err := s.Register(Echo{}); err != nil {
+		panic(err) // Echo 的方法签名是固定的, 注册不会失败
+	}
+	return s
+}
+
+var errMismatch = errors.New("benchmark: echo reply does not match the request")
+
+// Check reports whether reply echoes args.
+func Check(args, reply Payload) error {
+	if reply.Seq != args.Seq || len(reply.Data) != len(args.Data) {
+		return errMismatch
+	}
+	return nil
+}
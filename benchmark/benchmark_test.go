@@ -0,0 +1,150 @@
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tearpc"
+	"tearpc/codec"
+	"testing"
+)
+
+var (
+	codecs      = []codec.Type{codec.GobType, codec.JsonType}
+	payloads    = []int{16, 1 << 10, 64 << 10}
+	concurrency = []int{1, 16, 128}
+)
+
+func sizeName(n int) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// "application/gob" -> "gob"
+func codecName(ct codec.Type) string { return strings.TrimPrefix(string(ct), "application/") }
+
+func dial(tb testing.TB, addr string, ct codec.Type) *tearpc.Client {
+	tb.Helper()
+	client, err := tearpc.XDial(addr, &tearpc.Option{MagicNumber: tearpc.DefaultMagicNumber, CodecType: ct})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client
+}
+
+func TestTransports(t *testing.T) {
+	for _, transport := range Transports {
+		addr, stop, err := StartServer(NewServer(), transport)
+		if err != nil {
+			t.Fatalf("%s: %v", transport, err)
+		}
+		for _, ct := range codecs {
+			client := dial(t, addr, ct)
+			args := NewPayload(100)
+			args.Seq = 7
+			var reply Payload
+			if err := client.Call(context.Background(), "Echo.Echo", args, &reply); err != nil || Check(args, reply) != nil {
+				t.Fatalf("%s/%s: %+v %v", transport, ct, reply, err)
+			}
+			_ = client.Close()
+		}
+		stop()
+	}
+}
+
+// BenchmarkCall 对每种传输、编码、负载大小和并发数测量一次 Client.Call 的耗时.
+// 所有并发的调用共用一个连接, 和真实的客户端一样
+func BenchmarkCall(b *testing.B) {
+	for _, transport := range Transports {
+		b.Run(transport, func(b *testing.B) {
+			addr, stop, err := StartServer(NewServer(), transport)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer stop()
+			for _, ct := range codecs {
+				b.Run(codecName(ct), func(b *testing.B) {
+					client := dial(b, addr, ct)
+					defer func() { _ = client.Close() }()
+					for _, size := range payloads {
+						for _, c := range concurrency {
+							b.Run(fmt.Sprintf("%s/c%d", sizeName(size), c), func(b *testing.B) {
+								benchmarkCall(b, client, size, c)
+							})
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func benchmarkCall(b *testing.B, client *tearpc.Client, size, c int) {
+	args := NewPayload(size)
+	b.SetBytes(int64(2 * size)) // 请求和响应各一份
+	b.ReportAllocs()
+	var n int64 = -1
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply Payload
+			for {
+				seq := atomic.AddInt64(&n, 1)
+				if seq >= int64(b.N) {
+					return
+				}
+				a := args
+				a.Seq = int(seq)
+				if err := client.Call(context.Background(), "Echo.Echo", a, &reply); err != nil {
+					b.Error(err)
+					return
+				}
+				if err := Check(a, reply); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// discardConn 吞掉所有写入, 只测量编码本身
+type discardConn struct{}
+
+func (discardConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+// BenchmarkCodecWrite 测量 codec 写一个响应的开销, 不经过网络
+func BenchmarkCodecWrite(b *testing.B) {
+	for _, ct := range codecs {
+		for _, size := range payloads {
+			b.Run(fmt.Sprintf("%s/%s", codecName(ct), sizeName(size)), func(b *testing.B) {
+				cc := codec.NewCodecFuncMap[ct](discardConn{})
+				h := &codec.Header{ServerMethod: "Echo.Echo"}
+				body := NewPayload(size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					h.Seq = uint64(i)
+					if err := cc.Write(h, &body); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -3,15 +3,18 @@ package tearpc
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"tearpc/codec"
 	"time"
 )
@@ -24,41 +27,89 @@ type Call struct {
 	Reply        interface{}
 	Error        error
 	Done         chan *Call
+	meta         map[string]string // 随请求发送的元数据
+	start        time.Time
+	target       *targetStats
+	span         *Span
+	exporter     SpanExporter
+	onDone       func() // 不为空时在发送到 Done 之前调用, 给 Future 用
+	// 请求和响应的字节数: send 和 receive 在不同的 goroutine 里写入
+	reqSize, respSize int64
 }
 
 // 当一次 call调用接收到rpc的时候,调用done函数,向chan 发送消息,标识已经完成
 func (c *Call) done() {
+	c.finish(c.Error)
+	if c.onDone != nil {
+		c.onDone()
+	}
 	c.Done <- c
 }
 
+// finish 记录调用的指标, 每个 call 只会调用一次
+func (c *Call) finish(err error) {
+	if c.target != nil {
+		c.target.end(c.ServerMethod, err, time.Since(c.start))
+	}
+	if c.span != nil {
+		c.span.RequestSize = atomic.LoadInt64(&c.reqSize)
+		c.span.ResponseSize = atomic.LoadInt64(&c.respSize)
+		c.span.finish(c.exporter, err)
+	}
+}
+
 type Client struct {
-	cc       codec.Codec
-	sending  *sync.Mutex
-	opt      *Option
-	header   *codec.Header
-	mu       *sync.Mutex
-	seq      uint64 // 内部使用,不导出
-	pending  map[uint64]*Call
-	closing  bool
-	shutdown bool
+	cc         codec.Codec
+	sending    *sync.Mutex
+	opt        *Option
+	header     *codec.Header
+	mu         *sync.Mutex
+	seq        uint64 // 内部使用,不导出
+	pending    map[uint64]*Call
+	closing    bool
+	shutdown   bool
+	done       chan struct{} // receive 退出时关闭
+	doneOnce   sync.Once
+	conn       net.Conn      // 开启心跳时用来设置读超时, 为空时只靠心跳循环检测
+	counted    *countingConn // 统计收发的字节数, 每个调用的请求和响应大小也从这里读
+	lastActive int64         // 最近一次收到数据或者写出有进展的时间, unix nano
+	failErr    error         // 连接被主动断开的原因, 比如心跳超时
+	// 服务端在响应里声明的每个方法默认的调用超时: "Service.Method" -> time.Duration
+	callTimeouts sync.Map
+	addr         string // 服务端的地址
+	log          *slog.Logger
+	target       *targetStats // 按目标地址统计的指标
 }
 
 // client的构造函数
-func newClientCodec(cc codec.Codec, opt *Option) *Client {
+func newClientCodec(cc codec.Codec, conn net.Conn, counted *countingConn, opt *Option, addr string, target *targetStats) *Client {
 	client := &Client{
-		cc:       cc,
-		sending:  &sync.Mutex{},
-		opt:      opt,
-		header:   &codec.Header{},
-		mu:       &sync.Mutex{},
-		seq:      1,
-		pending:  make(map[uint64]*Call),
-		closing:  false,
-		shutdown: false,
+		conn:       conn,
+		counted:    counted,
+		addr:       addr,
+		log:        loggerOrDiscard(opt.Logger).With("addr", addr),
+		target:     target,
+		cc:         cc,
+		sending:    &sync.Mutex{},
+		opt:        opt,
+		header:     &codec.Header{},
+		mu:         &sync.Mutex{},
+		seq:        1,
+		pending:    make(map[uint64]*Call),
+		closing:    false,
+		shutdown:   false,
+		done:       make(chan struct{}),
+		lastActive: time.Now().UnixNano(),
+	}
+	if p, ok := counted.ReadWriteCloser.(*progressConn); ok { // 开始收发之前设置, 不用加锁
+		p.client = client
 	}
 
 	// 这里可以开始receive 消息了
 	go receive(client, cc)
+	if opt.HeartbeatInterval > 0 {
+		go client.heartbeat()
+	}
 	return client
 }
 
@@ -71,44 +122,136 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 func NewClient(conn net.Conn, opt *Option) (client *Client, err error) {
 	createCodecFunc := codec.NewCodecFuncMap[opt.CodecType]
 	if createCodecFunc == nil {
-		err := fmt.Errorf("NewClient: invalid codec type %s", opt.CodecType)
-		log.Println("rpc client: codec err: ", err)
-		return nil, err
+		return nil, fmt.Errorf("NewClient: invalid codec type %s", opt.CodecType)
+	}
+	if opt.Credentials != nil { // 握手时的凭证放到 option 里一起发送
+		auth, err := opt.Credentials.HandshakeMetadata()
+		if err != nil {
+			return nil, err
+		}
+		o := *opt
+		o.Auth = auth
+		opt = &o
 	}
+	addr := targetName(conn)
+	target := targetFor(conn, addr) // 客户端关闭时释放
+	var rwc io.ReadWriteCloser = conn
+	if opt.HeartbeatInterval > 0 {
+		rwc = &progressConn{Conn: conn}
+	}
+	counted := newCountingConn(rwc, &target.receivedBytes, &target.sentBytes)
 	// 经过确认 opt没问题了再发送
-	_ = json.NewEncoder(conn).Encode(opt) // 发送option
-	log.Println("Client: send opt done!")
+	_ = json.NewEncoder(counted).Encode(opt) // 发送option
+	loggerOrDiscard(opt.Logger).Debug("rpc client: sent option", "addr", addr, "codec", opt.CodecType)
 
 	// newClientCodec 不可能出问题
-	return newClientCodec(createCodecFunc((conn)), opt), nil
+	atomic.AddInt64(&target.connections, 1)
+	client = newClientCodec(createCodecFunc(counted), conn, counted, opt, addr, target)
+	if opt.LoadCallTimeouts {
+		client.loadCallTimeouts()
+	}
+	return client, nil
 }
 
-func funcTimeCost() func(string) {
-	beginTime := time.Now()
-	return func(fn string) {
-		log.Printf("func time stats: %s|%v", fn, time.Since(beginTime))
+// 没有设置 ConnectTimeout 时, 加载默认调用超时最多等这么久, 服务端一直不回复也不会让 NewClient 卡住
+var loadCallTimeoutsTimeout = 5 * time.Second
+
+// loadCallTimeouts 通过反射服务加载服务端声明的默认调用超时, 这样从第一次调用起就生效.
+// 服务端关闭了反射服务、版本太旧或者超时没有回复时忽略错误, 之后仍然从响应头里学习.
+// 这次调用是连接的一部分, 不计入客户端的指标, 也不记录 span, 但服务端会像其他调用一样记录它
+func (c *Client) loadCallTimeouts() {
+	timeout := c.opt.ConnectTimeout
+	if timeout <= 0 {
+		timeout = loadCallTimeoutsTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var timeouts map[string]time.Duration
+	call := &Call{
+		ServerMethod: ReflectionService + ".CallTimeouts",
+		Argv:         0,
+		Reply:        &timeouts,
+		Done:         make(chan *Call, 1),
+		start:        time.Now(),
+	}
+	<-c.sendContext(ctx, call, cancel).Done
+	if call.Error != nil {
+		c.log.Debug("rpc client: load call timeouts failed", "err", call.Error)
+		return
+	}
+	for method, d := range timeouts {
+		if d > 0 {
+			c.callTimeouts.Store(method, d)
+		}
 	}
 }
 
 // Go 封装异步调用
-// 在内部构造 call 结构体
+// 在内部构造 call 结构体. 服务端给方法声明了默认的调用超时的话, 超时后 call 以 DeadlineExceeded 完成
 func (c *Client) Go(ServerMethon string, argv, reply interface{}, done chan *Call) *Call {
+	ctx, cancel := c.withCallTimeout(context.Background(), ServerMethon)
+	if _, ok := ctx.Deadline(); !ok {
+		return c.goCall(ctx, ServerMethon, argv, reply, done)
+	}
+	return c.sendContext(ctx, c.newCall(ctx, ServerMethon, argv, reply, done), cancel)
+}
+
+// sendContext 发送 call, 不为调用启动 goroutine: ctx 结束时还没有完成的调用从 pending 里取走,
+// 和 Call 的超时一样处理. call 完成时停止监听 ctx, 然后调用 onDone
+func (c *Client) sendContext(ctx context.Context, call *Call, onDone func()) *Call {
+	var mu sync.Mutex
+	var finished bool
+	var stop func() bool
+	call.onDone = func() {
+		mu.Lock()
+		finished = true
+		if stop != nil {
+			stop()
+		}
+		mu.Unlock()
+		onDone()
+	}
+	c.send(call)
+
+	mu.Lock()
+	if !finished {
+		stop = context.AfterFunc(ctx, func() {
+			if c.removeCall(call.Seq) != nil {
+				call.Error = c.abandon(call, ctx.Err())
+				call.done()
+			}
+		})
+	}
+	mu.Unlock()
+	return call
+}
+
+// goCall 和 Go 一样, 另外从 ctx 中取出要发送的元数据和父 span
+func (c *Client) goCall(ctx context.Context, ServerMethon string, argv, reply interface{}, done chan *Call) *Call {
+	return c.send(c.newCall(ctx, ServerMethon, argv, reply, done))
+}
+
+// newCall 构造一个还没有发送的 call
+func (c *Client) newCall(ctx context.Context, ServerMethon string, argv, reply interface{}, done chan *Call) *Call {
 	// 因为使用了有缓冲的channel, 所以是非阻塞的
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
-		log.Panic("Client: done channel is unbuffered")
+		panic("rpc client: done channel is unbuffered")
 	}
 	call := &Call{
 		ServerMethod: ServerMethon,
 		Argv:         argv,
 		Reply:        reply,
 		Done:         done,
+		meta:         outgoingMetadata(ctx),
+		start:        time.Now(),
+		target:       c.target,
+		span:         c.startSpan(ctx, ServerMethon),
+		exporter:     c.opt.SpanExporter,
 	}
-	if c == nil {
-		log.Printf("client c is nil")
+	if c.target != nil {
+		c.target.begin(ServerMethon)
 	}
-	c.send(call)
 	return call
 }
 
@@ -135,18 +278,40 @@ func (c *Client) Call(serviceMethod string, args, reply interface{}) error {
 */
 
 func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := c.Go(serviceMethod, args, reply, make(chan *Call, 1)) // 非阻塞
+	ctx, cancel := c.withCallTimeout(ctx, serviceMethod)
+	defer cancel()
+	call := c.goCall(ctx, serviceMethod, args, reply, make(chan *Call, 1)) // 非阻塞
 	// 看看超时和rpc调用哪个先完成
 	select {
 	case <-ctx.Done():
-		c.removeCall(call.Seq)
-		log.Println("client Call timeout: call.Seq = ", call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		st := c.abandon(call, ctx.Err())
+		if c.removeCall(call.Seq) != nil { // 已经从 pending 里拿走的 call 会由 done 记录
+			call.finish(st)
+		}
+		return st
 	case _call := <-call.Done: // 这里可能会名字冲突
 		return _call.Error
 	}
 }
 
+// withCallTimeout 在调用方没有设置超时的时候, 使用服务端声明的默认超时
+func (c *Client) withCallTimeout(ctx context.Context, serviceMethod string) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok {
+		if d, ok := c.callTimeouts.Load(serviceMethod); ok {
+			return context.WithTimeout(ctx, d.(time.Duration))
+		}
+	}
+	return ctx, func() {}
+}
+
+// abandon 返回调用方不再等待 call 时的错误
+func (c *Client) abandon(call *Call, err error) *Status {
+	c.log.Debug("rpc client: call abandoned", "seq", call.Seq, "method", call.ServerMethod, "err", err)
+	st := StatusFromError(err)
+	st.Message = "rpc client: call failed: " + st.Message
+	return st
+}
+
 func Done(call *Call) {
 	<-call.Done // wait call finish
 }
@@ -156,7 +321,6 @@ func (c *Client) removeCall(seqId uint64) *Call {
 	defer c.mu.Unlock()
 	call := c.pending[seqId] // 从pending列表里面删除对应的序列号
 	delete(c.pending, seqId)
-	log.Printf("remove %v, call == nil ? %v, client = %p", seqId, call == nil, c)
 	return call
 }
 
@@ -166,53 +330,81 @@ func receive(client *Client, cc codec.Codec) {
 	for err == nil {
 		var header codec.Header
 		// log.Println("receive  run")
+		before := client.counted.bytesRead()
+		client.setReadDeadline()
 		err = cc.ReadHeader(&header)
 		if err != nil {
 			// log.Println("Client receive: ReadHeader err:", err.Error())
 			// continue // 接收头部有问题,直接break
 			break
 		}
+		client.active() // body 重新计时
+		if header.CallTimeout > 0 {
+			client.callTimeouts.Store(header.ServerMethod, header.CallTimeout)
+		}
+		if isPong(&header) {
+			err = cc.ReadBody(nil)
+			continue
+		}
 
 		// call := client.pending[header.Seq] //? Note:收到请求后这里要删除对应的call, 否则内存无法释放
 		call := client.removeCall(header.Seq)
 
 		switch { // swich 是可以不带表达式的,直接在case里面判断
 		case call == nil:
-			log.Printf("call [seq = %v] is not in client.pending %p", header.Seq, client)
+			client.log.Debug("rpc client: response to an abandoned call", "seq", header.Seq, "method", header.ServerMethod)
 			err = cc.ReadBody(nil)
-		case header.Error != "":
-			log.Printf("receive: ReadBody: err: %v", header.Error)
-
+		case header.Error != "" || header.Code != uint32(OK):
 			/*
 				2023/03/11 17:00:32 receive: ReadHeader err: gob: type mismatch in decoder: want struct type codec.Header; got non-struct
 				2023/03/11 17:00:32 Client: encounter error:  gob: type mismatch in decoder: want struct type codec.Header; got non-struct
 
 				当客户端试图读取的类型与服务器写入的类型不一致时
 			*/
-			call.Error = fmt.Errorf(header.Error) // 将error通过string传输,现在再转换为对应的error
+			st := decodeStatus(&header) // 将error通过header传输,现在再还原为对应的Status
+			call.Error = st
+			if st.Code == ResourceExhausted && header.RetryAfter > 0 { // 被服务端限流了
+				call.Error = &RateLimitError{RetryAfter: header.RetryAfter, status: st}
+			}
 			err = cc.ReadBody(nil)
+			atomic.StoreInt64(&call.respSize, client.counted.bytesRead()-before)
 			call.done()
-		case header.Error == "":
-			log.Printf("receive: ReadBody Error = empty")
+		default:
 			err = cc.ReadBody(call.Reply) //从body中读取数据到 call.replay中
+			atomic.StoreInt64(&call.respSize, client.counted.bytesRead()-before)
 			call.done()
 		}
 	}
 	// log.Println("Client: encounter error: ", err.Error())
+	if errors.Is(err, os.ErrDeadlineExceeded) && client.opt.HeartbeatInterval > 0 {
+		client.fail(ErrHeartbeatTimeout) // 读超时是 setReadDeadline 设置的, 关闭连接让阻塞的写也返回
+	}
 	client.terminalClient(err)
 }
 
 var ErrShutDown = errors.New("Client ShutDown")
 
+// terminalClient 只生效一次, 之后的调用什么都不做
 func (c *Client) terminalClient(err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	for _, call_ptr := range c.pending {
-		call_ptr.Error = err
-		call_ptr.done()
-	}
+	c.doneOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		close(c.done)
+		c.shutdown = true
+		if c.target != nil {
+			atomic.AddInt64(&c.target.connections, -1)
+			c.target.release()
+		}
+		if c.failErr != nil {
+			err = c.failErr
+		}
 
+		for seq, call_ptr := range c.pending {
+			call_ptr.Error = err
+			call_ptr.done()
+			delete(c.pending, seq)
+		}
+	})
 }
 
 // send
@@ -224,16 +416,44 @@ func (c *Client) send(call *Call) *Call {
 	c.sending.Lock()
 	defer c.sending.Unlock()
 
-	seq, _ := c.registerCall(call) // 因为header结构每个call 可以复用,所以把header放在了client上
+	seq, err := c.registerCall(call) // 因为header结构每个call 可以复用,所以把header放在了client上
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
 
 	c.header.Seq = seq
 	c.header.Error = ""
 	c.header.ServerMethod = call.ServerMethod
+	c.header.Meta = call.meta
+	c.header.TraceID, c.header.SpanID = "", ""
+	if call.span != nil {
+		c.header.TraceID, c.header.SpanID = call.span.TraceID, call.span.SpanID
+	}
+	if c.opt.Credentials != nil {
+		meta, err := c.opt.Credentials.CallMetadata(call.ServerMethod, seq)
+		if err != nil {
+			c.removeCall(seq)
+			call.Error = err
+			call.done()
+			return call
+		}
+		c.header.Meta = mergeMetadata(call.meta, meta) // 凭证优先
+	}
 	// 注意, 这里只发送了 header 和 argv 参数, 服务器在读取的时候也只需要读这两部分就好了
-	if err := c.cc.Write(c.header, call.Argv); err != nil {
-		log.Println("Client Write err: ", err.Error())
+	before := c.counted.bytesWritten()
+	err = c.cc.Write(c.header, call.Argv)
+	atomic.StoreInt64(&call.reqSize, c.counted.bytesWritten()-before)
+	if err != nil {
+		c.log.Warn("rpc client: write request failed", "seq", seq, "method", call.ServerMethod, "err", err)
 		call := c.removeCall(seq) // 这里发送失败要立即通知调用方哦
 		if call != nil {
+			c.mu.Lock()
+			if c.failErr != nil { // 连接是被主动断开的, 比如心跳超时, 报告断开的原因
+				err = c.failErr
+			}
+			c.mu.Unlock()
 			call.Error = err
 			call.done()
 		}
@@ -251,12 +471,13 @@ func (c *Client) registerCall(call *Call) (uint64, error) {
 	defer c.mu.Unlock()
 
 	// 如果关闭了,就停止发送
-	// todo
+	if c.closing || c.shutdown {
+		return 0, ErrShutDown
+	}
 
 	call.Seq = c.seq
 	c.seq++
 	c.pending[call.Seq] = call
-	log.Printf("registerCall client.seq=%v, client.seq=%v call==nil ? %v client=%p", call.Seq, c.seq, call == nil, c)
 
 	return call.Seq, nil
 }
@@ -340,13 +561,21 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 		return nil, err
 	}
 
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	target := acquireTarget(address)
+	defer target.release()
+	rawConn, err := dialNetwork(network, address, opt.ConnectTimeout)
 	if err != nil {
+		atomic.AddUint64(&target.dialFailures, 1)
 		return nil, err
 	}
+	var conn net.Conn = &dialedConn{Conn: rawConn, address: address, target: target}
+	if opt.TLSConfig != nil { // 握手会在第一次读写的时候进行, 也受 ConnectTimeout 的限制
+		conn = tls.Client(conn, tlsConfigFor(opt.TLSConfig, address))
+	}
 	// 此时已经建立连接, 如果后续出什么错误, 要关闭连接
 	defer func() {
 		if err != nil {
+			atomic.AddUint64(&target.handshakeFailures, 1)
 			_ = conn.Close() // 强调ignore错误
 		}
 	}()
@@ -371,6 +600,39 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	}
 }
 
+// dialedConn 记住 Dial 时的地址和已经找到的指标, 客户端的指标按这个地址区分
+type dialedConn struct {
+	net.Conn
+	address string
+	target  *targetStats
+}
+
+func asDialedConn(conn net.Conn) (*dialedConn, bool) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	dc, ok := conn.(*dialedConn)
+	return dc, ok
+}
+
+// targetFor 返回 conn 的指标并增加引用计数. Dial 的连接沿用 dial 时找到的指标, 不再查找一次
+func targetFor(conn net.Conn, addr string) *targetStats {
+	if dc, ok := asDialedConn(conn); ok && dc.target != nil {
+		return dc.target.retain()
+	}
+	return acquireTarget(addr)
+}
+
+func targetName(conn net.Conn) string {
+	if dc, ok := asDialedConn(conn); ok {
+		return dc.address
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
 // NewHTTPClient new a Client instance via HTTP as transport protocol
 func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
 	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultRPCPath))
@@ -378,7 +640,6 @@ func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
 	// Require successful HTTP response
 	// before swithing to RPC protocol.
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
-	log.Printf("resp=%v, err=%v", resp, err)
 	if err == nil && resp.Status == connected {
 		return NewClient(conn, opt)
 	}
@@ -395,6 +656,36 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 	return dialTimeout(NewHTTPClient, network, address, opts...)
 }
 
+// DialTLS connects to an RPC server over TLS. Option.TLSConfig is used when
+// set, otherwise the system roots verify the server certificate.
+func DialTLS(network, address string, opts ...*Option) (*Client, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := *opt // 不能修改 DefaultOption
+	if o.TLSConfig == nil {
+		o.TLSConfig = &tls.Config{}
+	}
+	return dialTimeout(NewClient, network, address, &o)
+}
+
+// 没有指定 ServerName 时, 使用地址中的 host 校验服务端证书
+func tlsConfigFor(config *tls.Config, address string) *tls.Config {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// XDial 根据 protocol@addr 格式的地址建立连接, 例如:
+// http@10.0.0.1:7001, tls@10.0.0.1:7002, tcp@10.0.0.1:9999, unix@/tmp/geerpc.sock, pipe@name
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -405,8 +696,10 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		return DialTLS("tcp", addr, opts...)
 	default:
-		// tcp. unix or other transport protocol
+		// tcp, unix, pipe or other transport protocol
 		return Dial(protocol, addr, opts...)
 	}
 }
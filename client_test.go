@@ -4,7 +4,7 @@ import (
 	"context"
 	"log"
 	"net"
-	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -37,30 +37,43 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
-func startServer(addr chan string) {
+// 在进程内的 pipe 上启动一个只有 Bar 的服务, 不需要等待端口就绪
+func startServer(t *testing.T) string {
 	var b Bar
-	_ = Register(&b)
-	// pick a free port
-	l, _ := net.Listen("tcp", ":0")
-	addr <- l.Addr().String()
-	Accept(l)
+	s := NewServer()
+	_ = s.Register(&b)
+	l, err := ListenPipe("")
+	_assert(err == nil, "listen failed: %v", err)
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return l.Addr().String()
+}
+
+// 在随机端口上启动 s, 返回连上它的客户端
+func dialTestServer(s *Server, opts ...*Option) (*Client, func()) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go s.Accept(l)
+	client, err := Dial("tcp", l.Addr().String(), opts...)
+	_assert(err == nil, "dial failed: %v", err)
+	return client, func() {
+		_ = client.Close()
+		_ = l.Close()
+	}
 }
 
 func TestClient_Call(t *testing.T) {
 	t.Parallel()
-	addrCh := make(chan string)
-	go startServer(addrCh)
-	addr := <-addrCh
-	time.Sleep(time.Second)
+	addr := startServer(t)
 	t.Run("client timeout", func(t *testing.T) {
-		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		client, _ := Dial(PipeNetwork, addr)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
 	t.Run("server handle timeout", func(t *testing.T) {
-		client, _ := Dial("tcp", addr, &Option{
+		client, _ := Dial(PipeNetwork, addr, &Option{
 			HandleTimeout: time.Second,
 		})
 		var reply int
@@ -76,18 +89,28 @@ func TestClient_Call(t *testing.T) {
 func TestXDial(t *testing.T) {
 	if runtime.GOOS == "linux" {
 		ch := make(chan struct{})
-		addr := "/tmp/geerpc.sock"
+		addr := filepath.Join(t.TempDir(), "geerpc.sock")
 		go func() {
-			_ = os.Remove(addr)
 			l, err := net.Listen("unix", addr)
 			if err != nil {
-				t.Fatal("failed to listen unix socket")
+				t.Error("failed to listen unix socket")
+				return
 			}
 			ch <- struct{}{}
 			Accept(l)
 		}()
 		<-ch
-		_, err := XDial("http@" + addr)
+		_, err := XDial("unix@" + addr)
 		_assert(err == nil, "failed to connect unix socket")
 	}
+
+	l, err := ListenPipe("")
+	_assert(err == nil, "listen failed: %v", err)
+	defer func() { _ = l.Close() }()
+	go Accept(l)
+	client, err := XDial("pipe@" + l.Addr().String())
+	_assert(err == nil, "failed to connect pipe: %v", err)
+	_ = client.Close()
+	_, err = XDial("pipe@no-such-listener")
+	_assert(err != nil && strings.Contains(err.Error(), "connection refused"), "expect connection refused, got %v", err)
 }
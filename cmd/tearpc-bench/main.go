@@ -0,0 +1,143 @@
+// Command tearpc-bench is a load generator for tearpc. It calls Echo.Echo
+// with a payload of the given size and reports QPS and latency percentiles.
+//
+//	tearpc-bench -transport unix -codec json -payload 4096 -c 64 -d 10s
+//	tearpc-bench -addr tcp@10.0.0.1:9999 -n 100000 -c 32
+//
+// Without -addr it starts an in-process server on -transport (tcp, unix,
+// http or pipe). A remote server must register benchmark.Echo.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"tearpc"
+	"tearpc/benchmark"
+	"tearpc/codec"
+	"tearpc/internal/stats"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+type config struct {
+	addr      string
+	transport string
+	codec     string
+	payload   int
+	n, c      int
+	d         time.Duration
+	timeout   time.Duration
+	conns     int
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	cfg, ok := parse(args, stderr)
+	if !ok {
+		return 2
+	}
+	if err := bench(cfg, stdout); err != nil {
+		fmt.Fprintln(stderr, "tearpc-bench:", err)
+		return 1
+	}
+	return 0
+}
+
+func parse(args []string, stderr io.Writer) (*config, bool) {
+	var cfg config
+	fs := flag.NewFlagSet("tearpc-bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cfg.addr, "addr", "", "server address, protocol@addr; empty starts an in-process server")
+	fs.StringVar(&cfg.transport, "transport", "tcp", "transport of the in-process server: tcp, unix, http or pipe")
+	fs.StringVar(&cfg.codec, "codec", "gob", "codec: gob or json")
+	fs.IntVar(&cfg.payload, "payload", 1024, "payload size in bytes")
+	fs.IntVar(&cfg.n, "n", 10000, "number of calls to make; with -d it is unlimited unless given")
+	fs.IntVar(&cfg.c, "c", 16, "number of concurrent callers")
+	fs.DurationVar(&cfg.d, "d", 0, "run for this long instead of -n calls")
+	fs.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "timeout of each call, 0 for none")
+	fs.IntVar(&cfg.conns, "conns", 1, "number of connections the callers share")
+	if err := fs.Parse(args); err != nil {
+		return nil, false
+	}
+	if fs.NArg() != 0 || cfg.payload < 0 || cfg.conns < 1 {
+		fs.Usage()
+		return nil, false
+	}
+	// -n 的默认值只用于没有 -d 的情况, 否则按时长压测时最多只会调用 10000 次
+	if cfg.d > 0 {
+		nSet := false
+		fs.Visit(func(f *flag.Flag) { nSet = nSet || f.Name == "n" })
+		if !nSet {
+			cfg.n = 0
+		}
+	}
+	return &cfg, true
+}
+
+// 每次调用的 ctx, 带上 -timeout 指定的超时
+func (cfg *config) context() (context.Context, context.CancelFunc) {
+	if cfg.timeout > 0 {
+		return context.WithTimeout(context.Background(), cfg.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func bench(cfg *config, w io.Writer) error {
+	opt := *tearpc.DefaultOption
+	switch cfg.codec {
+	case "gob":
+		opt.CodecType = codec.GobType
+	case "json":
+		opt.CodecType = codec.JsonType
+	default:
+		return fmt.Errorf("unknown codec %q", cfg.codec)
+	}
+
+	addr := cfg.addr
+	if addr == "" {
+		var stop func()
+		var err error
+		addr, stop, err = benchmark.StartServer(benchmark.NewServer(), cfg.transport)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	clients := make([]*tearpc.Client, cfg.conns)
+	for i := range clients {
+		client, err := tearpc.XDial(addr, &opt)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = client.Close() }()
+		clients[i] = client
+	}
+
+	payload := benchmark.NewPayload(cfg.payload)
+	var seq int64
+	res := stats.Load(cfg.n, cfg.c, cfg.d, func() error {
+		n := atomic.AddInt64(&seq, 1)
+		args := payload
+		args.Seq = int(n)
+		ctx, cancel := cfg.context()
+		defer cancel()
+		var reply benchmark.Payload
+		if err := clients[n%int64(len(clients))].Call(ctx, "Echo.Echo", args, &reply); err != nil {
+			return err
+		}
+		return benchmark.Check(args, reply)
+	}, func(err error) string { return tearpc.CodeOf(err).String() })
+
+	fmt.Fprintf(w, "addr: %s, codec: %s, payload: %d bytes, connections: %d\n", addr, cfg.codec, cfg.payload, cfg.conns)
+	res.Print(w)
+	if res.Failed() > 0 {
+		return fmt.Errorf("%d of %d calls failed", res.Failed(), res.Calls)
+	}
+	return nil
+}
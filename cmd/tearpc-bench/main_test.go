@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	for _, transport := range []string{"tcp", "unix", "http", "pipe"} {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-transport", transport, "-codec", "json", "-n", "200", "-c", "8", "-conns", "2", "-payload", "64"}, &stdout, &stderr)
+		out := stdout.String()
+		if code != 0 || !strings.Contains(out, "calls: 200, ok: 200, errors: 0, concurrency: 8") || !strings.Contains(out, "p99") {
+			t.Fatalf("%s: %d %q %q", transport, code, out, stderr.String())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-codec", "xml"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "unknown codec") {
+		t.Fatalf("expect an unknown codec error, got %d %q", code, stderr.String())
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		n    int
+	}{
+		{nil, 10000},
+		{[]string{"-n", "50"}, 50},
+		{[]string{"-d", "10s"}, 0},
+		{[]string{"-d", "10s", "-n", "50"}, 50},
+	} {
+		cfg, ok := parse(tc.args, io.Discard)
+		if !ok || cfg.n != tc.n {
+			t.Fatalf("%v: got n = %+v, want %d", tc.args, cfg, tc.n)
+		}
+	}
+	if _, ok := parse([]string{"-conns", "0"}, io.Discard); ok {
+		t.Fatal("expect -conns 0 to be rejected")
+	}
+}
@@ -0,0 +1,380 @@
+// Command tearpc-gen generates typed clients for tearpc services.
+//
+// It reads the Go package in the current directory (or the one given as
+// argument), finds the methods of each -type that tearpc would register and
+// writes, next to it, a file holding for every type T:
+//
+//   - TService, the interface of the registered methods,
+//   - RegisterTService, registering an implementation on a *tearpc.Server,
+//   - TClient, with one typed method per RPC: Sum(ctx, Args) (int, error).
+//
+// Typical use is a go:generate directive beside the service type:
+//
+//	//go:generate go run tearpc/cmd/tearpc-gen -type Foo
+//
+// The server registration goes through TService, so a service type that no
+// longer matches the generated client stops compiling until it is
+// regenerated.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("tearpc-gen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	typeNames := fs.String("type", "", "comma-separated list of service types")
+	name := fs.String("name", "", "service name, when it differs from the type name (single -type only)")
+	output := fs.String("output", "", "output file, default <type>_tearpc.go in the package directory")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: tearpc-gen -type T[,T...] [-name Name] [-output file] [dir]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *typeNames == "" || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	dir := "."
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+	typs := strings.Split(*typeNames, ",")
+	if *name != "" && len(typs) > 1 {
+		fmt.Fprintln(stderr, "tearpc-gen: -name needs a single -type")
+		return 2
+	}
+
+	src, warnings, err := generate(dir, typs, *name)
+	for _, w := range warnings {
+		fmt.Fprintln(stderr, "tearpc-gen:", w)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "tearpc-gen:", err)
+		return 1
+	}
+	out := *output
+	if out == "" {
+		out = filepath.Join(dir, strings.ToLower(typs[0])+"_tearpc.go")
+	}
+	if err := os.WriteFile(out, src, 0644); err != nil {
+		fmt.Fprintln(stderr, "tearpc-gen:", err)
+		return 1
+	}
+	return 0
+}
+
+type file struct {
+	Package  string
+	Imports  []string // 已经带上引号和别名, 比如 `"time"`, `pb "x/y/pb"`
+	Services []*service
+}
+
+type service struct {
+	Type    string
+	Name    string // 注册的服务名
+	Methods []*method
+}
+
+type method struct {
+	Name    string
+	WithCtx bool
+	Arg     string
+	Reply   string // 去掉指针之后的返回值类型
+}
+
+// generate 解析 dir 下的包, 为 typs 生成代码. warnings 是被跳过的方法, 和 ReportSkipped 的规则一致
+func generate(dir string, typs []string, name string) ([]byte, []string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && !strings.HasSuffix(fi.Name(), "_tearpc.go")
+	}, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, nil, fmt.Errorf("expect one package in %s, found %d", dir, len(pkgs))
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+
+	out := &file{Package: pkg.Name}
+	imports := map[string]bool{`"context"`: true, `"tearpc"`: true}
+	var warnings []string
+	for _, typ := range typs {
+		svc := &service{Type: typ, Name: typ}
+		if name != "" {
+			svc.Name = name
+		}
+		found := false
+		for _, f := range pkg.Files {
+			found = found || declaresType(f, typ)
+			for _, decl := range f.Decls {
+				fd, ok := decl.(*ast.FuncDecl)
+				if !ok || receiverType(fd) != typ || !fd.Name.IsExported() {
+					continue
+				}
+				m, used, reason := checkMethod(f, fd)
+				if reason != "" {
+					warnings = append(warnings, fmt.Sprintf("%s.%s skipped: %s", typ, fd.Name.Name, reason))
+					continue
+				}
+				for _, imp := range used {
+					imports[imp] = true
+				}
+				svc.Methods = append(svc.Methods, m)
+			}
+		}
+		if !found {
+			return nil, warnings, fmt.Errorf("type %s not found in %s", typ, dir)
+		}
+		if len(svc.Methods) == 0 {
+			return nil, warnings, fmt.Errorf("type %s has no suitable methods", typ)
+		}
+		sort.Slice(svc.Methods, func(i, j int) bool { return svc.Methods[i].Name < svc.Methods[j].Name })
+		out.Services = append(out.Services, svc)
+	}
+	for imp := range imports {
+		out.Imports = append(out.Imports, imp)
+	}
+	sort.Strings(out.Imports)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, out); err != nil {
+		return nil, warnings, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, warnings, fmt.Errorf("format generated code: %v", err)
+	}
+	return src, warnings, nil
+}
+
+func declaresType(f *ast.File, typ string) bool {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			if spec.(*ast.TypeSpec).Name.Name == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func receiverType(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) != 1 {
+		return ""
+	}
+	t := fd.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// checkMethod 按照 registerMetods 的规则检查方法签名:
+// (args T, reply *R) error 或者 (ctx context.Context, args T, reply *R) error
+// 返回方法描述, 参数类型用到的 import, 或者跳过的原因
+func checkMethod(f *ast.File, fd *ast.FuncDecl) (*method, []string, string) {
+	var params []ast.Expr
+	for _, field := range fd.Type.Params.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, field.Type)
+		}
+	}
+	results := fd.Type.Results
+	if results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 || !isIdent(results.List[0].Type, "error") {
+		return nil, nil, "must return exactly one error"
+	}
+	m := &method{Name: fd.Name.Name}
+	switch len(params) {
+	case 2:
+	case 3:
+		if !isContext(f, params[0]) {
+			return nil, nil, "first of three arguments must be context.Context"
+		}
+		m.WithCtx = true
+		params = params[1:]
+	default:
+		return nil, nil, fmt.Sprintf("wrong number of arguments %d", len(params))
+	}
+	star, ok := params[1].(*ast.StarExpr)
+	if !ok {
+		return nil, nil, "reply must be a pointer"
+	}
+	if !exportedOrBuiltin(params[0]) {
+		return nil, nil, "argument type is not exported"
+	}
+	if !exportedOrBuiltin(star.X) {
+		return nil, nil, "reply type is not exported"
+	}
+	var used []string
+	for _, e := range []ast.Expr{params[0], star.X} {
+		imps, err := importsOf(f, e)
+		if err != nil {
+			return nil, nil, err.Error()
+		}
+		used = append(used, imps...)
+	}
+	m.Arg, m.Reply = exprString(params[0]), exprString(star.X)
+	return m, used, ""
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+func isContext(f *ast.File, e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && importPath(f, x.Name) == "context"
+}
+
+// 和服务端一样, 只看解引用之后的类型名: 具名类型必须导出, 预声明类型和匿名类型都可以
+func exportedOrBuiltin(e ast.Expr) bool {
+	for {
+		star, ok := e.(*ast.StarExpr)
+		if !ok {
+			break
+		}
+		e = star.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		if t.IsExported() {
+			return true
+		}
+		_, builtin := types.Universe.Lookup(t.Name).(*types.TypeName)
+		return builtin
+	case *ast.SelectorExpr:
+		return t.Sel.IsExported()
+	}
+	return true
+}
+
+// importsOf 找出类型表达式里引用的其他包, 生成的文件也要 import 它们
+func importsOf(f *ast.File, e ast.Expr) ([]string, error) {
+	var (
+		used []string
+		err  error
+	)
+	ast.Inspect(e, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		path := importPath(f, x.Name)
+		if path == "" {
+			err = fmt.Errorf("unknown package %s", x.Name)
+			return false
+		}
+		spec := fmt.Sprintf("%q", path)
+		if x.Name != filepath.Base(path) {
+			spec = x.Name + " " + spec
+		}
+		used = append(used, spec)
+		return false
+	})
+	return used, err
+}
+
+// importPath 返回文件 f 中名字为 name 的 import 的路径
+func importPath(f *ast.File, name string) string {
+	for _, imp := range f.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		local := filepath.Base(path)
+		if imp.Name != nil {
+			local = imp.Name.Name
+		}
+		if local == name {
+			return path
+		}
+	}
+	return ""
+}
+
+func exprString(e ast.Expr) string {
+	var buf bytes.Buffer
+	_ = format.Node(&buf, token.NewFileSet(), e)
+	return buf.String()
+}
+
+var tmpl = template.Must(template.New("tearpc").Parse(`// Code generated by tearpc-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+{{range .Services}}{{$svc := .}}
+// {{.Type}}Service is the set of methods served for the "{{.Name}}" service.
+type {{.Type}}Service interface {
+{{- range .Methods}}
+	{{.Name}}({{if .WithCtx}}ctx context.Context, {{end}}args {{.Arg}}, reply *{{.Reply}}) error
+{{- end}}
+}
+
+// Register{{.Type}}Service registers srv on s as the "{{.Name}}" service.
+func Register{{.Type}}Service(s *tearpc.Server, srv {{.Type}}Service, opts ...tearpc.ServiceOption) error {
+	return s.RegisterName("{{.Name}}", srv, opts...)
+}
+
+// {{.Type}}Client is a typed client of the "{{.Name}}" service.
+type {{.Type}}Client struct {
+	client *tearpc.Client
+}
+
+func New{{.Type}}Client(client *tearpc.Client) *{{.Type}}Client {
+	return &{{.Type}}Client{client: client}
+}
+{{range .Methods}}
+// {{.Name}} calls {{$svc.Name}}.{{.Name}}.
+func (c *{{$svc.Type}}Client) {{.Name}}(ctx context.Context, args {{.Arg}}) ({{.Reply}}, error) {
+	var reply {{.Reply}}
+	err := c.client.Call(ctx, "{{$svc.Name}}.{{.Name}}", args, &reply)
+	return reply, err
+}
+{{end}}{{end}}`))
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 提交的生成代码必须和重新生成的结果一致
+func TestGenerateExample(t *testing.T) {
+	dir := filepath.Join("..", "..", "examples", "calc")
+	src, warnings, err := generate(dir, []string{"Calc"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join(dir, "calc_tearpc.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Fatalf("calc_tearpc.go is stale, run go generate:\n%s", src)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Calc.Reset skipped") {
+		t.Fatalf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(src string) {
+		if err := os.WriteFile(filepath.Join(dir, "svc.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`package svc
+
+import (
+	ctx "context"
+	pb "example.com/api/v1"
+)
+
+type args struct{}
+
+type Store int
+
+func (s Store) Get(c ctx.Context, key string, reply *pb.Item) error { return nil }
+func (s *Store) List(prefix string, reply *[]*pb.Item) error     { return nil }
+func (s Store) private(key string, reply *string) error         { return nil }
+func (s Store) Bad(a args, reply *string) error                 { return nil }
+func (s Store) NoPtr(key string, reply string) error            { return nil }
+`)
+	src, warnings, err := generate(dir, []string{"Store"}, "kv.Store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`pb "example.com/api/v1"`,
+		`Get(ctx context.Context, args string, reply *pb.Item) error`,
+		`List(args string, reply *[]*pb.Item) error`,
+		`func (c *StoreClient) List(ctx context.Context, args string) ([]*pb.Item, error)`,
+		`c.client.Call(ctx, "kv.Store.Get", args, &reply)`,
+		`s.RegisterName("kv.Store", srv, opts...)`,
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("missing %q in\n%s", want, src)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expect Bad and NoPtr to be skipped, got %v", warnings)
+	}
+
+	if _, _, err := generate(dir, []string{"Missing"}, ""); err == nil {
+		t.Error("expect an error for a missing type")
+	}
+	write("package svc\n\ntype Empty int\n\nfunc (Empty) Nothing() {}\n")
+	if _, _, err := generate(dir, []string{"Empty"}, ""); err == nil {
+		t.Error("expect an error for a type without methods")
+	}
+}
@@ -0,0 +1,236 @@
+// Command tearpc is a command-line client for tearpc servers.
+//
+//	tearpc -addr tcp@localhost:9999 list
+//	tearpc -addr tcp@localhost:9999 describe Foo.Sum
+//	tearpc -addr tcp@localhost:9999 -H x-request-id=42 call Foo.Sum '{"Num1": 1, "Num2": 2}'
+//	tearpc -addr http@localhost:9999 -n 10000 -c 50 call Foo.Sum '{"Num1": 1, "Num2": 2}'
+//
+// The address uses the protocol@addr syntax of tearpc.XDial. The arguments
+// of call are a JSON document, or "-" to read it from stdin; the server must
+// keep the reflection service registered when using the gob codec.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"tearpc"
+	"tearpc/codec"
+	"tearpc/internal/stats"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// headers 收集重复出现的 -H key=value
+type headers map[string]string
+
+func (h headers) String() string { return fmt.Sprint(map[string]string(h)) }
+
+func (h headers) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expect key=value, got %q", s)
+	}
+	h[k] = v
+	return nil
+}
+
+type config struct {
+	addr     string
+	codec    string
+	timeout  time.Duration
+	meta     headers
+	token    string
+	insecure bool
+	n, c     int
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cfg := config{meta: headers{}}
+	fs := flag.NewFlagSet("tearpc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cfg.addr, "addr", "tcp@localhost:9999", "server address, protocol@addr (tcp, unix, http or tls)")
+	fs.StringVar(&cfg.codec, "codec", "gob", "codec: gob or json")
+	fs.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "timeout of each call, 0 for none")
+	fs.Var(cfg.meta, "H", "metadata sent with each call, key=value (repeatable)")
+	fs.StringVar(&cfg.token, "token", "", "bearer token sent when connecting")
+	fs.BoolVar(&cfg.insecure, "insecure", false, "skip verification of the server certificate (tls)")
+	fs.IntVar(&cfg.n, "n", 1, "number of calls to make")
+	fs.IntVar(&cfg.c, "c", 1, "number of concurrent callers")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: tearpc [flags] list | describe Service[.Method] | call Service.Method JSON")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	client, err := dial(&cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, "tearpc:", err)
+		return 1
+	}
+	defer func() { _ = client.Close() }()
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch {
+	case cmd == "list" && len(rest) == 0:
+		err = list(&cfg, client, stdout)
+	case cmd == "describe" && len(rest) == 1:
+		err = describe(&cfg, client, rest[0], stdout)
+	case cmd == "call" && len(rest) == 2:
+		err = call(&cfg, client, rest[0], rest[1], stdin, stdout)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "tearpc:", err)
+		return 1
+	}
+	return 0
+}
+
+func dial(cfg *config) (*tearpc.Client, error) {
+	opt := *tearpc.DefaultOption
+	switch cfg.codec {
+	case "gob":
+		opt.CodecType = codec.GobType
+	case "json":
+		opt.CodecType = codec.JsonType
+	default:
+		return nil, fmt.Errorf("unknown codec %q", cfg.codec)
+	}
+	if cfg.token != "" {
+		opt.Credentials = tearpc.TokenCredentials(cfg.token)
+	}
+	if strings.HasPrefix(cfg.addr, "tls@") {
+		opt.TLSConfig = &tls.Config{InsecureSkipVerify: cfg.insecure}
+	}
+	return tearpc.XDial(cfg.addr, &opt)
+}
+
+// 每次调用的 ctx: 带上超时和 -H 指定的元数据
+func (cfg *config) context() (context.Context, context.CancelFunc) {
+	ctx := tearpc.WithMetadata(context.Background(), cfg.meta)
+	if cfg.timeout > 0 {
+		return context.WithTimeout(ctx, cfg.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func list(cfg *config, client *tearpc.Client, w io.Writer) error {
+	ctx, cancel := cfg.context()
+	defer cancel()
+	var services []tearpc.ServiceInfo
+	if err := client.Call(ctx, tearpc.ReflectionService+".List", 0, &services); err != nil {
+		return err
+	}
+	for _, svc := range services {
+		for _, m := range svc.Methods {
+			fmt.Fprintf(w, "%s.%s(%s) %s\n", svc.Name, m.Name, typeName(m.ArgType), typeName(m.ReplyType))
+		}
+	}
+	return nil
+}
+
+// name 可以是服务名, 也可以是 Service.Method; 服务名里也可能有 ".", 所以先按服务名查
+func describe(cfg *config, client *tearpc.Client, name string, w io.Writer) error {
+	ctx, cancel := cfg.context()
+	defer cancel()
+	var svc tearpc.ServiceInfo
+	err := client.Call(ctx, tearpc.ReflectionService+".Service", name, &svc)
+	if err == nil {
+		return writeJSON(w, &svc)
+	}
+	if tearpc.CodeOf(err) != tearpc.NotFound || !strings.Contains(name, ".") {
+		return err
+	}
+	var m tearpc.MethodInfo
+	if err := client.Call(ctx, tearpc.ReflectionService+".Method", name, &m); err != nil {
+		return err
+	}
+	return writeJSON(w, &m)
+}
+
+func call(cfg *config, client *tearpc.Client, method, args string, stdin io.Reader, w io.Writer) error {
+	data := []byte(args)
+	if args == "-" {
+		var err error
+		if data, err = io.ReadAll(stdin); err != nil {
+			return err
+		}
+	}
+	if !json.Valid(data) {
+		return errors.New("arguments are not valid JSON")
+	}
+	dc := tearpc.NewDynamicClient(client)
+	if cfg.n <= 1 {
+		ctx, cancel := cfg.context()
+		defer cancel()
+		reply, err := dc.CallJSON(ctx, method, data)
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		if err := json.Unmarshal(reply, &v); err != nil {
+			return err
+		}
+		return writeJSON(w, v)
+	}
+	return load(cfg, dc, method, data, w)
+}
+
+// load 用 cfg.c 个 goroutine 一共发起 cfg.n 次调用, 最后输出 QPS 和延迟分布
+func load(cfg *config, dc *tearpc.DynamicClient, method string, data []byte, w io.Writer) error {
+	res := stats.Load(cfg.n, cfg.c, 0, func() error {
+		ctx, cancel := cfg.context()
+		defer cancel()
+		_, err := dc.CallJSON(ctx, method, data)
+		return err
+	}, func(err error) string { return tearpc.CodeOf(err).String() })
+	res.Print(w)
+	if res.Failed() > 0 {
+		return fmt.Errorf("%d of %d calls failed", res.Failed(), res.Calls)
+	}
+	return nil
+}
+
+func typeName(d *tearpc.TypeDesc) string {
+	if d == nil {
+		return ""
+	}
+	if d.Name != "" {
+		return d.Name
+	}
+	switch d.Kind {
+	case "ptr":
+		return "*" + typeName(d.Elem)
+	case "slice":
+		return "[]" + typeName(d.Elem)
+	case "array":
+		return fmt.Sprintf("[%d]%s", d.Len, typeName(d.Elem))
+	case "map":
+		return "map[" + typeName(d.Key) + "]" + typeName(d.Elem)
+	}
+	return d.Kind
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
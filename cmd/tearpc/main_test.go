@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"tearpc"
+	"testing"
+)
+
+type Calc int
+
+type Args struct{ Num1, Num2 int }
+
+func (c Calc) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (c Calc) Meta(ctx context.Context, key string, reply *string) error {
+	*reply = tearpc.MetadataFromContext(ctx)[key]
+	return nil
+}
+
+func startServer(t *testing.T) string {
+	s := tearpc.NewServer()
+	var c Calc
+	if err := s.Register(&c); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	addr := startServer(t)
+	exec := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(append([]string{"-addr", addr}, args...), strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := exec("", "list")
+	if code != 0 || !strings.Contains(out, "Calc.Sum(main.Args) *int") {
+		t.Fatalf("list: %d %q %q", code, out, errOut)
+	}
+
+	code, out, _ = exec("", "describe", "Calc.Sum")
+	var m tearpc.MethodInfo
+	if code != 0 || json.Unmarshal([]byte(out), &m) != nil || m.Name != "Sum" {
+		t.Fatalf("describe: %d %q", code, out)
+	}
+
+	for _, c := range []string{"gob", "json"} {
+		code, out, errOut = exec("", "-codec", c, "call", "Calc.Sum", `{"Num1": 1, "Num2": 2}`)
+		if code != 0 || strings.TrimSpace(out) != "3" {
+			t.Fatalf("call with %s: %d %q %q", c, code, out, errOut)
+		}
+	}
+
+	code, out, _ = exec(`"trace"`, "-H", "trace=abc", "call", "Calc.Meta", "-")
+	if code != 0 || strings.TrimSpace(out) != `"abc"` {
+		t.Fatalf("call with metadata: %d %q", code, out)
+	}
+
+	code, out, errOut = exec("", "-n", "100", "-c", "8", "call", "Calc.Sum", `{"Num1": 1, "Num2": 2}`)
+	if code != 0 || !strings.Contains(out, "calls: 100, ok: 100") || !strings.Contains(out, "p99") {
+		t.Fatalf("load: %d %q %q", code, out, errOut)
+	}
+
+	code, _, errOut = exec("", "call", "Calc.Nope", `{}`)
+	if code != 1 || !strings.Contains(errOut, "can't find method") {
+		t.Fatalf("unknown method: %d %q", code, errOut)
+	}
+
+	if code, _, _ = exec("", "bogus"); code != 2 {
+		t.Fatalf("expect usage error, got %d", code)
+	}
+}
@@ -1,6 +1,9 @@
 package codec
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 /*
 err = client.Call("Arith.Multiply", args, &reply)
@@ -12,9 +15,22 @@ err = client.Call("Arith.Multiply", args, &reply)
 */
 
 type Header struct {
-	ServerMethod string // format "Service.Method"
-	Seq          uint64 // sequence number chosen by client
-	Error        string //
+	ServerMethod string            // format "Service.Method"
+	Seq          uint64            // sequence number chosen by client
+	Error        string            //
+	RetryAfter   time.Duration     // 被限流时, 服务端建议客户端多久之后重试
+	Code         uint32            // 错误码, 0 表示成功
+	Details      []Detail          // 错误的附加信息
+	Meta         map[string]string // 请求的元数据, 比如认证信息
+	CallTimeout  time.Duration     // 服务端声明的这个方法默认的调用超时
+	TraceID      string            // 调用链的 id, 同一个调用链上的请求都相同
+	SpanID       string            // 发起这个请求的客户端 span, 服务端的 span 以它为父节点
+}
+
+// Detail 错误附加信息, Data 是 json 编码后的内容, Type 用来在客户端找到对应的类型
+type Detail struct {
+	Type string
+	Data []byte
 }
 
 // 对消息体进行辩解吗的接口Codec, 抽象出接口是为了实现不同的Codec实例 比如 gob, json
@@ -43,4 +59,5 @@ var NewCodecFuncMap map[Type]NewCodecFunc //这里是声明
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc) // 这里是初始化
 	NewCodecFuncMap[GobType] = NewGobCodec        // 定义在其他文件中, 需导出(首字母大写)
+	NewCodecFuncMap[JsonType] = NewJsonCodec
 }
@@ -3,8 +3,8 @@ package codec
 import (
 	"bufio"
 	"encoding/gob"
+	"fmt"
 	"io"
-	"log"
 )
 
 type GobCodec struct {
@@ -58,20 +58,17 @@ func (c *GobCodec) Write(head *Header, body interface{}) (err error) {
 	defer func() {
 		_ = c.buf.Flush()
 		if err != nil { // 如果此函数的处理中有发生错误, 这里直接关闭conn,避免在每次错误处理的时候都关闭,收敛错误处理代码
-			log.Println("gob Write buf.Flush err", err)
 			c.Close()
 		}
 	}()
 
 	if err = c.enc.Encode(head); err != nil {
-		log.Println("rpc codec: gob error encoding header:", err)
-		return err
+		return fmt.Errorf("rpc codec: gob error encoding header: %w", err)
 	}
 	// log.Printf("head send {%d} head=%v", head.Seq, head)
 
 	if err = c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: gob error encoding body:", err)
-		return err
+		return fmt.Errorf("rpc codec: gob error encoding body: %w", err)
 	}
 	// log.Printf("body send {%d} body=%v", head.Seq, body)
 
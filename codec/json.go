@@ -0,0 +1,62 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JsonCodec 每个 header 和 body 都是一个json值, 方便用其他语言或者命令行工具调试
+type JsonCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		enc:  json.NewEncoder(buf),
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+func (c *JsonCodec) ReadHeader(head *Header) error {
+	return c.dec.Decode(head)
+}
+
+// body 为 nil 时读出来丢掉
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *JsonCodec) Write(head *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	if err = c.enc.Encode(head); err != nil {
+		return fmt.Errorf("rpc codec: json error encoding header: %w", err)
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return fmt.Errorf("rpc codec: json error encoding body: %w", err)
+	}
+	return nil
+}
+
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
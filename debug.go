@@ -1,25 +1,132 @@
 package tearpc
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
-	"text/template"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tearpc/codec"
+	"time"
 )
 
+/*
+调试页面, HandleHTTP 注册在 /debug/geerpc 下面:
+	/debug/geerpc              所有内容
+	/debug/geerpc/services     注册的服务和方法
+	/debug/geerpc/connections  当前的连接: 对端地址, codec, 连接时长, 收发字节数
+	/debug/geerpc/requests     正在处理的请求和已经处理的时间
+	/debug/geerpc/methods      每个方法的调用次数、错误率和耗时分位数
+	/debug/geerpc/errors       最近的错误, 最新的在前
+每个页面加上 ?format=json 返回 JSON. 所有列表都按固定的顺序排列
+*/
+
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{if .Services}}
+	{{range .Services}}
+	<hr>
+	Service {{.Name}}{{if .Funcs}} (functions){{end}}
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Timeout</th><th align=center>Call Timeout</th>
+		{{range .Methods}}
+			<tr>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{if .Timeout}}{{.Timeout}}{{else}}-{{end}}</td>
+			<td align=center>{{if .CallTimeout}}{{.CallTimeout}}{{else}}-{{end}}</td>
+			</tr>
+		{{end}}
+		</table>
+		{{if .Skipped}}
+		<table>
+		<th align=center>Skipped Method</th><th align=center>Reason</th>
+		{{range .Skipped}}
+			<tr>
+			<td align=left font=fixed>{{.Method}}</td>
+			<td align=left>{{.Reason}}</td>
+			</tr>
+		{{end}}
+		</table>
+		{{end}}
+	{{end}}
+	{{end}}
+	{{if .Connections}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>ID</th><th align=center>Remote Addr</th><th align=center>Identity</th><th align=center>Codec</th><th align=center>Age</th><th align=center>Bytes Read</th><th align=center>Bytes Written</th><th align=center>In Flight</th>
+		{{range .Connections}}
+			<tr>
+			<td align=center>{{.ID}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=left>{{.Identity}}</td>
+			<td align=left>{{.Codec}}</td>
+			<td align=right>{{.Age}}</td>
+			<td align=right>{{.BytesRead}}</td>
+			<td align=right>{{.BytesWritten}}</td>
+			<td align=right>{{.InFlight}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Requests}}
+	<hr>
+	In-flight Requests
+	<hr>
+		<table>
+		<th align=center>Conn</th><th align=center>Seq</th><th align=center>Method</th><th align=center>Peer</th><th align=center>Elapsed</th>
+		{{range .Requests}}
+			<tr>
+			<td align=center>{{.Conn}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=left font=fixed>{{.Method}}</td>
+			<td align=left>{{.Peer}}</td>
+			<td align=right>{{.Elapsed}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Methods}}
+	<hr>
+	Method Statistics
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th><th align=center>Error Rate</th><th align=center>In Flight</th><th align=center>p50</th><th align=center>p90</th><th align=center>p99</th>
+		{{range .Methods}}
+			<tr>
+			<td align=left font=fixed>{{.Service}}.{{.Method}}</td>
+			<td align=right>{{.Calls}}</td>
+			<td align=right>{{.Errors}}</td>
+			<td align=right>{{printf "%.2f%%" .ErrorPercent}}</td>
+			<td align=right>{{.InFlight}}</td>
+			<td align=right>{{.P50}}</td>
+			<td align=right>{{.P90}}</td>
+			<td align=right>{{.P99}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Errors}}
 	<hr>
-	Service {{.Name}}
+	Recent Errors
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mtype := .Method}}
+		<th align=center>Time</th><th align=center>Method</th><th align=center>Seq</th><th align=center>Peer</th><th align=center>Code</th><th align=center>Message</th>
+		{{range .Errors}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=left>{{.Time.Format "2006-01-02 15:04:05.000"}}</td>
+			<td align=left font=fixed>{{.Method}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=left>{{.Peer}}</td>
+			<td align=left>{{.Code}}</td>
+			<td align=left>{{.Message}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -33,32 +140,357 @@ type debugHTTP struct {
 	*Server
 }
 
+// debugPage 是调试页面的数据, 单个视图只填对应的字段
+type debugPage struct {
+	Services    []debugService
+	Connections []debugConn
+	Requests    []debugRequest
+	Methods     []debugMethod
+	Errors      []debugError
+}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name    string
+	Funcs   bool
+	Methods []debugMethodDesc
+	Skipped []SkippedMethod `json:",omitempty"`
+}
+
+type debugMethodDesc struct {
+	Name        string
+	ArgType     string
+	ReplyType   string
+	Calls       uint64
+	Timeout     time.Duration `json:",omitempty"`
+	CallTimeout time.Duration `json:",omitempty"`
+}
+
+type debugConn struct {
+	ID           uint64
+	RemoteAddr   string
+	Identity     string `json:",omitempty"`
+	Codec        codec.Type
+	Since        time.Time
+	Age          time.Duration
+	BytesRead    uint64
+	BytesWritten uint64
+	InFlight     int
+}
+
+type debugRequest struct {
+	Conn    uint64
+	Seq     uint64
+	Method  string
+	Peer    string
+	Start   time.Time
+	Elapsed time.Duration
+}
+
+type debugMethod struct {
+	Service      string
+	Method       string
+	Calls        uint64 // 处理完的请求, 包括失败的
+	Errors       uint64
+	ErrorPercent float64
+	InFlight     int64
+	Codes        map[string]uint64
+	// 分位数是从耗时直方图估算出来的
+	P50, P90, P99 time.Duration
+}
+
+type debugError struct {
+	Time    time.Time
+	Method  string
+	Seq     uint64
+	Peer    string `json:",omitempty"`
+	Code    string
+	Message string
 }
 
 // Runs at /debug/geerpc
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// build a sorted version of the data
-	var services []debugService
+	var page debugPage
+	view := strings.Trim(strings.TrimPrefix(req.URL.Path, defaultDebugPath), "/")
+	switch view {
+	case "", "services", "connections", "requests", "methods", "errors":
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	all := view == ""
+	var data interface{} = &page // 单个视图的 JSON 直接是一个列表
+	if all || view == "services" {
+		page.Services = server.debugServices()
+		data = page.Services
+	}
+	if all || view == "connections" {
+		page.Connections = server.debugConns()
+		data = page.Connections
+	}
+	if all || view == "requests" {
+		page.Requests = server.debugRequests()
+		data = page.Requests
+	}
+	if all || view == "methods" {
+		page.Methods = server.debugMethods()
+		data = page.Methods
+	}
+	if all || view == "errors" {
+		page.Errors = server.loadRecentErrors().list()
+		data = page.Errors
+	}
+
+	if req.URL.Query().Get("format") == "json" {
+		if all {
+			data = &page
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(data)
+		return
+	}
+	err := debug.Execute(w, page)
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template")
+	}
+}
+
+// 按服务名排序, 每个服务的方法按方法名排序
+func (server *Server) debugServices() []debugService {
+	services := []debugService{}
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
-		})
+		ds := debugService{Name: namei.(string), Funcs: svc.funcs, Skipped: svc.skipped}
+		for name, m := range svc.methods() {
+			ds.Methods = append(ds.Methods, debugMethodDesc{
+				Name:        name,
+				ArgType:     m.ArgType.String(),
+				ReplyType:   m.ReplyType.String(),
+				Calls:       m.NumberCalls(),
+				Timeout:     m.Timeout,
+				CallTimeout: m.CallTimeout,
+			})
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		services = append(services, ds)
 		return true
 	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
 
-	err := debug.Execute(w, services)
-	if err != nil {
-		_, _ = fmt.Fprintln(w, "rpc: error executing template")
+// trackConn 记录一个完成握手的连接, 连接关闭时调用 untrackConn
+func (server *Server) trackConn(peer *Peer, codecType codec.Type, conn *countingConn) *serverConnState {
+	st := &serverConnState{peer: peer, codec: codecType, since: time.Now(), conn: conn, requests: make(map[*request]time.Time)}
+	server.connMu.Lock()
+	defer server.connMu.Unlock()
+	if server.conns == nil {
+		server.conns = make(map[*serverConnState]struct{})
+	}
+	server.connSeq++
+	st.id = server.connSeq
+	server.conns[st] = struct{}{}
+	return st
+}
+
+func (server *Server) untrackConn(st *serverConnState) {
+	server.connMu.Lock()
+	defer server.connMu.Unlock()
+	delete(server.conns, st)
+}
+
+func (st *serverConnState) addRequest(req *request) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.requests[req] = time.Now()
+}
+
+func (st *serverConnState) removeRequest(req *request) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.requests, req)
+}
+
+func (server *Server) connStates() []*serverConnState {
+	server.connMu.Lock()
+	defer server.connMu.Unlock()
+	conns := make([]*serverConnState, 0, len(server.conns))
+	for st := range server.conns {
+		conns = append(conns, st)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// 按连接建立的顺序排列
+func (server *Server) debugConns() []debugConn {
+	now := time.Now()
+	conns := []debugConn{}
+	for _, st := range server.connStates() {
+		st.mu.Lock()
+		inflight := len(st.requests)
+		st.mu.Unlock()
+		conns = append(conns, debugConn{
+			ID:           st.id,
+			RemoteAddr:   addrString(st.peer),
+			Identity:     st.peer.Identity,
+			Codec:        st.codec,
+			Since:        st.since,
+			Age:          now.Sub(st.since).Round(time.Millisecond),
+			BytesRead:    atomic.LoadUint64(&st.conn.read),
+			BytesWritten: atomic.LoadUint64(&st.conn.written),
+			InFlight:     inflight,
+		})
+	}
+	return conns
+}
+
+// 按开始时间排列, 最早的在前
+func (server *Server) debugRequests() []debugRequest {
+	now := time.Now()
+	requests := []debugRequest{}
+	for _, st := range server.connStates() {
+		st.mu.Lock()
+		for req, start := range st.requests {
+			requests = append(requests, debugRequest{
+				Conn:    st.id,
+				Seq:     req.Header.Seq,
+				Method:  req.Header.ServerMethod,
+				Peer:    addrString(st.peer),
+				Start:   start,
+				Elapsed: now.Sub(start).Round(time.Microsecond),
+			})
+		}
+		st.mu.Unlock()
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if !requests[i].Start.Equal(requests[j].Start) {
+			return requests[i].Start.Before(requests[j].Start)
+		}
+		if requests[i].Conn != requests[j].Conn {
+			return requests[i].Conn < requests[j].Conn
+		}
+		return requests[i].Seq < requests[j].Seq
+	})
+	return requests
+}
+
+// 按 service, method 排序
+func (server *Server) debugMethods() []debugMethod {
+	m := server.loadMetrics()
+	m.mu.Lock()
+	methods := make([]debugMethod, 0, len(m.methods))
+	for k, st := range m.methods {
+		dm := debugMethod{Service: k.service, Method: k.method, InFlight: st.inflight, Codes: make(map[string]uint64)}
+		for code, n := range st.codes {
+			dm.Calls += n
+			if code != OK {
+				dm.Errors += n
+			}
+			dm.Codes[code.String()] = n
+		}
+		if dm.Calls > 0 {
+			dm.ErrorPercent = 100 * float64(dm.Errors) / float64(dm.Calls)
+		}
+		dm.P50 = st.latency.quantile(.5)
+		dm.P90 = st.latency.quantile(.9)
+		dm.P99 = st.latency.quantile(.99)
+		methods = append(methods, dm)
+	}
+	m.mu.Unlock()
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].Service != methods[j].Service {
+			return methods[i].Service < methods[j].Service
+		}
+		return methods[i].Method < methods[j].Method
+	})
+	return methods
+}
+
+// quantile 用直方图估算分位数: 找到所在的桶, 在桶的上下界之间线性插值
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cum uint64
+	lower := 0.0
+	for i, le := range latencyBuckets {
+		n := h.counts[i]
+		if float64(cum+n) >= rank && n > 0 {
+			v := lower + (le-lower)*(rank-float64(cum))/float64(n)
+			return time.Duration(v * float64(time.Second))
+		}
+		cum += n
+		lower = le
+	}
+	return time.Duration(lower * float64(time.Second)) // 落在 +Inf 的桶里, 只能给出最大的上界
+}
+
+func addrString(p *Peer) string {
+	if p == nil || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// 最近的错误保存多少条
+const recentErrorsSize = 64
+
+// errorRing 保存最近的错误, 满了之后覆盖最早的
+type errorRing struct {
+	mu   sync.Mutex
+	errs []debugError
+	next int
+	full bool
+}
+
+func newErrorRing(size int) *errorRing { return &errorRing{errs: make([]debugError, size)} }
+
+// loadRecentErrors 在第一次用到时才创建, 和 loadMetrics 一样
+func (server *Server) loadRecentErrors() *errorRing {
+	server.errorsOnce.Do(func() { server.recentErrors = newErrorRing(recentErrorsSize) })
+	return server.recentErrors
+}
+
+func (r *errorRing) add(h *codec.Header, peer *Peer) {
+	e := debugError{
+		Time:    time.Now(),
+		Method:  h.ServerMethod,
+		Seq:     h.Seq,
+		Peer:    addrString(peer),
+		Code:    Code(h.Code).String(),
+		Message: h.Error,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs[r.next] = e
+	r.next = (r.next + 1) % len(r.errs)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list 返回保存的错误, 最新的在前
+func (r *errorRing) list() []debugError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.errs)
+	}
+	out := make([]debugError, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.errs[(r.next-i+len(r.errs))%len(r.errs)])
 	}
+	return out
 }
 
 func (server *Server) HandleHTTP() {
 	http.Handle(defaultRPCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	http.Handle(defaultDebugPath+"/", debugHTTP{server})
+	http.Handle(defaultMetricsPath, metricsHTTP{server})
+	server.logger().Debug("rpc server: debug path registered", "path", defaultDebugPath)
 }
@@ -0,0 +1,115 @@
+package tearpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"tearpc/codec"
+	"testing"
+	"time"
+)
+
+func getDebug(s *Server, path string, v interface{}) string {
+	rec := httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(rec, httptest.NewRequest("GET", defaultDebugPath+path, nil))
+	if v != nil {
+		_assert(json.Unmarshal(rec.Body.Bytes(), v) == nil, "bad json from %s: %s", path, rec.Body.String())
+	}
+	if rec.Code != 200 {
+		return rec.Result().Status
+	}
+	return rec.Body.String()
+}
+
+func TestDebugHTTP(t *testing.T) {
+	s := NewServer()
+	var l Lifecycle
+	_ = s.Register(&l)
+	client, cleanup := dialTestServer(s)
+	defer cleanup()
+
+	var reply int
+	err := client.Call(context.Background(), "Lifecycle.Fail", 0, &reply)
+	_assert(err != nil, "expect an error")
+	_ = client.Call(context.Background(), "Lifecycle.Sleep", time.Millisecond, &reply)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.Call(context.Background(), "Lifecycle.Sleep", 300*time.Millisecond, &reply)
+	}()
+	defer func() { <-done }()
+
+	var requests []debugRequest
+	for i := 0; i < 100 && len(requests) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+		getDebug(s, "/requests?format=json", &requests)
+	}
+	_assert(len(requests) == 1 && requests[0].Method == "Lifecycle.Sleep" && requests[0].Elapsed > 0,
+		"unexpected requests %+v", requests)
+
+	var conns []debugConn
+	getDebug(s, "/connections?format=json", &conns)
+	_assert(len(conns) == 1 && conns[0].Codec == DefaultOption.CodecType && conns[0].InFlight == 1 &&
+		conns[0].BytesRead > 0 && conns[0].BytesWritten > 0 && conns[0].RemoteAddr != "", "unexpected connections %+v", conns)
+
+	var methods []debugMethod
+	getDebug(s, "/methods?format=json", &methods)
+	_assert(len(methods) == 2 && methods[0].Method == "Fail" && methods[1].Method == "Sleep", "unexpected methods %+v", methods)
+	_assert(methods[0].Calls == 1 && methods[0].ErrorPercent == 100 && methods[0].Codes["Unknown"] == 1, "unexpected stats %+v", methods[0])
+	_assert(methods[1].Calls == 1 && methods[1].InFlight == 1 && methods[1].P50 > 0, "unexpected stats %+v", methods[1])
+
+	var errs []debugError
+	getDebug(s, "/errors?format=json", &errs)
+	_assert(len(errs) == 1 && errs[0].Method == "Lifecycle.Fail" && errs[0].Message == "failed" && errs[0].Peer != "",
+		"unexpected errors %+v", errs)
+
+	var services []debugService
+	getDebug(s, "/services?format=json", &services)
+	_assert(len(services) == 2 && services[0].Name == "Lifecycle" && services[1].Name == ReflectionService, "unexpected services %+v", services)
+
+	page := getDebug(s, "", nil)
+	for _, want := range []string{"Service Lifecycle", "Connections", "In-flight Requests", "Lifecycle.Sleep", "Recent Errors"} {
+		_assert(strings.Contains(page, want), "missing %q in the overview", want)
+	}
+	_assert(strings.HasPrefix(getDebug(s, "/nope", nil), "404"), "expect 404 for an unknown view")
+}
+
+func TestDebugHTTP_ZeroServer(t *testing.T) {
+	s := &Server{}
+	var l Lifecycle
+	_ = s.Register(&l)
+	client, cleanup := dialTestServer(s)
+	defer cleanup()
+
+	var reply int
+	_assert(client.Call(context.Background(), "Lifecycle.Fail", 0, &reply) != nil, "expect an error")
+	var errs []debugError
+	for i := 0; i < 100 && len(errs) == 0; i++ { // 错误在响应发出之后才记录
+		getDebug(s, "/errors?format=json", &errs)
+		time.Sleep(time.Millisecond)
+	}
+	_assert(len(errs) == 1 && errs[0].Method == "Lifecycle.Fail", "unexpected errors %+v", errs)
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h histogram
+	_assert(h.quantile(.5) == 0, "empty histogram")
+	for i := 0; i < 100; i++ {
+		h.observe(.003) // 落在 (0.0025, 0.005] 的桶里
+	}
+	q := h.quantile(.5)
+	_assert(q > 2500*time.Microsecond && q <= 5*time.Millisecond, "unexpected p50 %s", q)
+	h.observe(100)
+	_assert(h.quantile(1) == 10*time.Second, "the +Inf bucket reports the largest bound, got %s", h.quantile(1))
+}
+
+func TestErrorRing(t *testing.T) {
+	r := newErrorRing(3)
+	_assert(len(r.list()) == 0, "expect no errors")
+	for i := 1; i <= 5; i++ {
+		r.add(&codec.Header{Seq: uint64(i), Code: uint32(Internal)}, nil)
+	}
+	errs := r.list()
+	_assert(len(errs) == 3 && errs[0].Seq == 5 && errs[2].Seq == 3, "unexpected errors %+v", errs)
+}
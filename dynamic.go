@@ -0,0 +1,259 @@
+package tearpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"reflect"
+	"sync"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+动态调用: 不需要编译期的 Go 类型, 只要方法名和一个 JSON 文档就可以调用
+
+	dc := tearpc.NewDynamicClient(client)
+	reply, err := dc.CallJSON(ctx, "Foo.Sum", []byte(`{"Num1": 1, "Num2": 2}`))
+
+- json codec: 参数直接以 JSON 发送, 返回值也直接以 JSON 读取
+- gob codec: gob 需要具体的类型, 先通过反射服务(tearpc.Reflection)拿到 ArgType/ReplyType 的 TypeDesc,
+  用 reflect 动态构造出对应的类型, 再在 JSON 和这些类型之间转换. gob 按字段名匹配结构体, 所以类型名不同也没关系
+*/
+
+// DynamicClient calls methods by name with generic values instead of
+// compiled Go types.
+type DynamicClient struct {
+	client  *Client
+	mu      sync.Mutex
+	methods map[string]*dynamicMethod // "Service.Method" -> 动态构造的类型
+}
+
+type dynamicMethod struct {
+	argType   reflect.Type
+	replyType reflect.Type // 指针类型
+}
+
+func NewDynamicClient(client *Client) *DynamicClient {
+	return &DynamicClient{client: client, methods: make(map[string]*dynamicMethod)}
+}
+
+// Call invokes serviceMethod with args, a generic value such as a
+// map[string]interface{} (anything encoding/json can marshal), and returns
+// the reply decoded into generic maps, slices, strings, bools and json.Number.
+func (d *DynamicClient) Call(ctx context.Context, serviceMethod string, args interface{}) (interface{}, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, Errorf(InvalidArgument, "rpc client: encode args: %v", err)
+	}
+	out, err := d.CallJSON(ctx, serviceMethod, data)
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+	if err := dec.Decode(&reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// CallJSON invokes serviceMethod with a JSON document as argument and
+// returns the reply as a JSON document.
+func (d *DynamicClient) CallJSON(ctx context.Context, serviceMethod string, args []byte) ([]byte, error) {
+	if d.client.opt.CodecType == codec.JsonType {
+		var reply json.RawMessage
+		if err := d.client.Call(ctx, serviceMethod, json.RawMessage(args), &reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+
+	m, err := d.method(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	argv := reflect.New(m.argType)
+	if err := json.Unmarshal(args, argv.Interface()); err != nil {
+		return nil, Errorf(InvalidArgument, "rpc client: args do not match %s: %v", m.argType, err)
+	}
+	replyv := reflect.New(m.replyType.Elem())
+	if err := d.client.Call(ctx, serviceMethod, argv.Elem().Interface(), replyv.Interface()); err != nil {
+		return nil, err
+	}
+	return json.Marshal(replyv.Interface())
+}
+
+// 通过反射服务查询方法的参数类型, 结果会缓存下来
+func (d *DynamicClient) method(ctx context.Context, serviceMethod string) (*dynamicMethod, error) {
+	d.mu.Lock()
+	m, ok := d.methods[serviceMethod]
+	d.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	var info MethodInfo
+	if err := d.client.Call(ctx, ReflectionService+".Method", serviceMethod, &info); err != nil {
+		return nil, err
+	}
+	argType, err := TypeFromDesc(info.ArgType)
+	if err != nil {
+		return nil, err
+	}
+	replyType, err := TypeFromDesc(info.ReplyType)
+	if err != nil {
+		return nil, err
+	}
+	m = &dynamicMethod{argType: argType, replyType: replyType}
+	d.mu.Lock()
+	d.methods[serviceMethod] = m
+	d.mu.Unlock()
+	return m, nil
+}
+
+var basicTypes = map[string]reflect.Type{
+	reflect.Bool.String():       reflect.TypeOf(false),
+	reflect.Int.String():        reflect.TypeOf(int(0)),
+	reflect.Int8.String():       reflect.TypeOf(int8(0)),
+	reflect.Int16.String():      reflect.TypeOf(int16(0)),
+	reflect.Int32.String():      reflect.TypeOf(int32(0)),
+	reflect.Int64.String():      reflect.TypeOf(int64(0)),
+	reflect.Uint.String():       reflect.TypeOf(uint(0)),
+	reflect.Uint8.String():      reflect.TypeOf(uint8(0)),
+	reflect.Uint16.String():     reflect.TypeOf(uint16(0)),
+	reflect.Uint32.String():     reflect.TypeOf(uint32(0)),
+	reflect.Uint64.String():     reflect.TypeOf(uint64(0)),
+	reflect.Uintptr.String():    reflect.TypeOf(uintptr(0)),
+	reflect.Float32.String():    reflect.TypeOf(float32(0)),
+	reflect.Float64.String():    reflect.TypeOf(float64(0)),
+	reflect.Complex64.String():  reflect.TypeOf(complex64(0)),
+	reflect.Complex128.String(): reflect.TypeOf(complex128(0)),
+	reflect.String.String():     reflect.TypeOf(""),
+	reflect.Interface.String():  reflect.TypeOf((*interface{})(nil)).Elem(),
+}
+
+// 字段不导出, 但是自己实现了编解码的具名类型, 不能按字段重新构造
+var wellKnownTypes = map[string]reflect.Type{
+	"time.Time": reflect.TypeOf(time.Time{}),
+}
+
+// 描述来自服务端, 不能信任: reflect 的 ArrayOf, MapOf, StructOf 遇到不合法的输入会 panic,
+// 所以构造之前先检查, 并且限制描述的深度、节点数和构造出的类型的大小
+const (
+	maxTypeDepth = 32
+	maxTypeNodes = 4096
+	maxTypeSize  = 1 << 30 // 字节
+)
+
+// TypeFromDesc builds a Go type equivalent to desc: same kinds and exported
+// field names, so that gob and json encode it like the original type.
+// Recursive references become interface{} since reflect can't build
+// recursive unnamed types. Since desc usually comes from a server, it is
+// validated, and descriptions that are too deep or too large are rejected.
+func TypeFromDesc(desc *TypeDesc) (reflect.Type, error) {
+	var b typeBuilder
+	return b.build(desc, 0)
+}
+
+type typeBuilder struct {
+	nodes int // 已经处理的描述节点数
+}
+
+func (b *typeBuilder) build(desc *TypeDesc, depth int) (reflect.Type, error) {
+	if desc == nil {
+		return nil, fmt.Errorf("rpc client: missing type description")
+	}
+	if depth > maxTypeDepth {
+		return nil, fmt.Errorf("rpc client: type description nested deeper than %d", maxTypeDepth)
+	}
+	if b.nodes++; b.nodes > maxTypeNodes {
+		return nil, fmt.Errorf("rpc client: type description has more than %d nodes", maxTypeNodes)
+	}
+	if t, ok := wellKnownTypes[desc.Name]; ok {
+		return t, nil
+	}
+	if t, ok := basicTypes[desc.Kind]; ok {
+		return t, nil
+	}
+	switch desc.Kind {
+	case reflect.Ptr.String():
+		elem, err := b.build(desc.Elem, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+	case reflect.Slice.String():
+		elem, err := b.build(desc.Elem, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	case reflect.Array.String():
+		elem, err := b.build(desc.Elem, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if desc.Len < 0 || desc.Len > maxTypeSize || elem.Size() > 0 && uint64(desc.Len) > maxTypeSize/uint64(elem.Size()) {
+			return nil, fmt.Errorf("rpc client: bad array length %d of %s", desc.Len, elem)
+		}
+		return reflect.ArrayOf(desc.Len, elem), nil
+	case reflect.Map.String():
+		key, err := b.build(desc.Key, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if !key.Comparable() {
+			return nil, fmt.Errorf("rpc client: map key %s is not comparable", key)
+		}
+		elem, err := b.build(desc.Elem, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, elem), nil
+	case reflect.Struct.String():
+		if desc.Ref {
+			return basicTypes[reflect.Interface.String()], nil
+		}
+		return b.buildStruct(desc, depth)
+	}
+	return nil, fmt.Errorf("rpc client: unsupported kind %s", desc.Kind)
+}
+
+func (b *typeBuilder) buildStruct(desc *TypeDesc, depth int) (reflect.Type, error) {
+	fields := make([]reflect.StructField, 0, len(desc.Fields))
+	names := make(map[string]bool, len(desc.Fields))
+	var size uint64
+	for _, f := range desc.Fields {
+		if !token.IsIdentifier(f.Name) || !token.IsExported(f.Name) {
+			return nil, fmt.Errorf("rpc client: bad field name %q", f.Name)
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("rpc client: duplicate field %s", f.Name)
+		}
+		names[f.Name] = true
+		ft, err := b.build(f.Type, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		// 嵌入的字段 json 会展开编码, 保留下来才能和原来的类型编码成一样的 JSON.
+		// reflect 不支持嵌入带方法的类型, 嵌入的也只能是结构体或者结构体的指针
+		if f.Anonymous && !embeddable(ft) {
+			return nil, fmt.Errorf("rpc client: can't embed %s as field %s", ft, f.Name)
+		}
+		if size += uint64(ft.Size()); size > maxTypeSize {
+			return nil, fmt.Errorf("rpc client: struct larger than %d bytes", maxTypeSize)
+		}
+		fields = append(fields, reflect.StructField{Name: f.Name, Type: ft, Tag: reflect.StructTag(f.Tag), Anonymous: f.Anonymous})
+	}
+	return reflect.StructOf(fields), nil
+}
+
+func embeddable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t.NumMethod() == 0 && reflect.PtrTo(t).NumMethod() == 0
+}
@@ -0,0 +1,106 @@
+package tearpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"tearpc/codec"
+	"testing"
+	"time"
+)
+
+type Item struct {
+	Name  string `json:"name"`
+	Price float64
+}
+
+type Order struct {
+	ID    int
+	Items []Item
+	Tags  map[string]string
+	At    time.Time
+}
+
+type Shop int
+
+func (s Shop) Total(o Order, reply *Order) error {
+	*reply = o
+	for _, it := range o.Items {
+		reply.Tags["total"] = reply.Tags["total"] + it.Name
+	}
+	return nil
+}
+
+func TestDynamicClient(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	var shop Shop
+	_ = s.Register(&foo)
+	_ = s.Register(&shop)
+
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, done := dialTestServer(s, &Option{CodecType: ct})
+		dc := NewDynamicClient(client)
+
+		reply, err := dc.Call(context.Background(), "Foo.Sum", map[string]interface{}{"Num1": 1, "Num2": 2})
+		_assert(err == nil && reply == json.Number("3"), "%s: expect 3, got %v, %v", ct, reply, err)
+
+		doc := `{"ID": 7, "Items": [{"name": "a", "Price": 1.5}, {"name": "b"}], "Tags": {"x": "y"}, "At": "2024-01-02T03:04:05Z"}`
+		out, err := dc.CallJSON(context.Background(), "Shop.Total", []byte(doc))
+		_assert(err == nil, "%s: Shop.Total failed: %v", ct, err)
+		var order Order
+		_ = json.Unmarshal(out, &order)
+		_assert(order.ID == 7 && len(order.Items) == 2 && order.Items[0].Price == 1.5 && order.Tags["total"] == "ab" &&
+			order.At.Year() == 2024, "%s: wrong reply %s", ct, out)
+
+		_, err = dc.CallJSON(context.Background(), "Foo.Nope", []byte(`{}`))
+		_assert(err != nil, "%s: unknown methods should fail", ct)
+		done()
+	}
+}
+
+type Base struct {
+	ID int
+}
+
+type Derived struct {
+	Base
+	Name string
+}
+
+func TestTypeFromDesc_Embedded(t *testing.T) {
+	typ, err := TypeFromDesc(DescribeType(reflect.TypeOf(Derived{})))
+	_assert(err == nil, "build type failed: %v", err)
+	v := reflect.New(typ)
+	err = json.Unmarshal([]byte(`{"ID":1,"Name":"x"}`), v.Interface())
+	_assert(err == nil, "unmarshal failed: %v", err)
+	b, _ := json.Marshal(v.Interface())
+	want, _ := json.Marshal(Derived{Base{1}, "x"})
+	_assert(string(b) == string(want), "embedded fields must keep their JSON shape: got %s, want %s", b, want)
+}
+
+func TestTypeFromDesc_Invalid(t *testing.T) {
+	intDesc := &TypeDesc{Kind: "int"}
+	field := func(name string) FieldDesc { return FieldDesc{Name: name, Type: intDesc} }
+	deep := intDesc
+	for i := 0; i <= maxTypeDepth; i++ {
+		deep = &TypeDesc{Kind: "ptr", Elem: deep}
+	}
+	for name, desc := range map[string]*TypeDesc{
+		"negative array":  {Kind: "array", Len: -1, Elem: intDesc},
+		"huge array":      {Kind: "array", Len: 1 << 40, Elem: intDesc},
+		"nested arrays":   {Kind: "array", Len: 1 << 20, Elem: &TypeDesc{Kind: "array", Len: 1 << 20, Elem: intDesc}},
+		"slice map key":   {Kind: "map", Key: &TypeDesc{Kind: "slice", Elem: intDesc}, Elem: intDesc},
+		"empty field":     {Kind: "struct", Fields: []FieldDesc{field("")}},
+		"unexported":      {Kind: "struct", Fields: []FieldDesc{field("x")}},
+		"bad identifier":  {Kind: "struct", Fields: []FieldDesc{field("A-B")}},
+		"duplicate field": {Kind: "struct", Fields: []FieldDesc{field("A"), field("A")}},
+		"embedded int":    {Kind: "struct", Fields: []FieldDesc{{Name: "A", Type: intDesc, Anonymous: true}}},
+		"embedded time":   {Kind: "struct", Fields: []FieldDesc{{Name: "Time", Type: &TypeDesc{Kind: "struct", Name: "time.Time"}, Anonymous: true}}},
+		"too deep":        deep,
+		"missing elem":    {Kind: "slice"},
+	} {
+		typ, err := TypeFromDesc(desc)
+		_assert(err != nil, "%s: expect an error, got %v", name, typ)
+	}
+}
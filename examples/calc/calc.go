@@ -0,0 +1,33 @@
+// Package calc is a small service used to show the code generated by
+// tearpc-gen; calc_tearpc.go is regenerated with go generate.
+package calc
+
+import (
+	"context"
+	"time"
+)
+
+//go:generate go run tearpc/cmd/tearpc-gen -type Calc
+
+type Args struct{ Num1, Num2 int }
+
+type Calc struct{}
+
+func (c *Calc) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// Sleep 等待 d 之后返回当前时间, 调用方取消时提前返回
+func (c *Calc) Sleep(ctx context.Context, d time.Duration, reply *time.Time) error {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	*reply = time.Now()
+	return nil
+}
+
+// 不满足 tearpc 的签名, 不会生成
+func (c *Calc) Reset() {}
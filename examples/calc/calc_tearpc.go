@@ -0,0 +1,43 @@
+// Code generated by tearpc-gen. DO NOT EDIT.
+
+package calc
+
+import (
+	"context"
+	"tearpc"
+	"time"
+)
+
+// CalcService is the set of methods served for the "Calc" service.
+type CalcService interface {
+	Sleep(ctx context.Context, args time.Duration, reply *time.Time) error
+	Sum(args Args, reply *int) error
+}
+
+// RegisterCalcService registers srv on s as the "Calc" service.
+func RegisterCalcService(s *tearpc.Server, srv CalcService, opts ...tearpc.ServiceOption) error {
+	return s.RegisterName("Calc", srv, opts...)
+}
+
+// CalcClient is a typed client of the "Calc" service.
+type CalcClient struct {
+	client *tearpc.Client
+}
+
+func NewCalcClient(client *tearpc.Client) *CalcClient {
+	return &CalcClient{client: client}
+}
+
+// Sleep calls Calc.Sleep.
+func (c *CalcClient) Sleep(ctx context.Context, args time.Duration) (time.Time, error) {
+	var reply time.Time
+	err := c.client.Call(ctx, "Calc.Sleep", args, &reply)
+	return reply, err
+}
+
+// Sum calls Calc.Sum.
+func (c *CalcClient) Sum(ctx context.Context, args Args) (int, error) {
+	var reply int
+	err := c.client.Call(ctx, "Calc.Sum", args, &reply)
+	return reply, err
+}
@@ -0,0 +1,28 @@
+package calc
+
+import (
+	"context"
+	"tearpc"
+	"tearpc/tearpctest"
+	"testing"
+	"time"
+)
+
+func TestCalcClient(t *testing.T) {
+	s := tearpc.NewServer()
+	if err := RegisterCalcService(s, &Calc{}); err != nil {
+		t.Fatal(err)
+	}
+	client := tearpctest.Dial(t, tearpctest.Serve(t, s))
+
+	calc := NewCalcClient(client)
+	sum, err := calc.Sum(context.Background(), Args{Num1: 1, Num2: 2})
+	if err != nil || sum != 3 {
+		t.Fatalf("Sum = %d, %v", sum, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := calc.Sleep(ctx, time.Second); tearpc.CodeOf(err) != tearpc.DeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+}
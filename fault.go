@@ -0,0 +1,340 @@
+package tearpc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+故障注入, 用来验证客户端的重试和超时逻辑:
+1、Server.Faults 不为空时, 服务端的每个连接都套上一层会出故障的 codec 和连接, 需要在 Accept 之前设置
+2、故障的配置可以在运行时修改: 测试里调用 FaultInjector.Set, 或者通过 Server.FaultsHandler 返回的 handler
+   GET 查看配置和统计, POST 设置新的配置(JSON 格式的 FaultConfig), DELETE 清除所有故障.
+   这个 handler 可以修改服务端的行为, 并且没有认证, HandleHTTP 不会注册它, 需要自己挂在只有测试能访问的地方:
+
+	mux.Handle("/debug/geerpc/faults", server.FaultsHandler())
+3、延迟/断开/丢弃/乱序/篡改按这个顺序作用在响应上, 心跳不受影响. Errors 里的方法在调用之前就返回错误
+4、延迟由定时器在到期后发送, 不占用连接, 同一个连接上其他的响应照常发出
+*/
+
+// FaultConfig describes the faults to inject. Rates are probabilities in
+// [0, 1] evaluated per response; durations are in nanoseconds in JSON.
+type FaultConfig struct {
+	// Methods 不为空时, 响应的故障只作用于这些方法, Errors 不受影响
+	Methods []string `json:",omitempty"`
+	// 发送响应之前的延迟, 再加上 [0, Jitter) 的随机延迟
+	Latency time.Duration `json:",omitempty"`
+	Jitter  time.Duration `json:",omitempty"`
+	// 不发送响应, 调用方只能等超时
+	DropRate float64 `json:",omitempty"`
+	// 响应推迟到同一个连接的下一个响应之后发送, 最多推迟 reorderHold
+	ReorderRate float64 `json:",omitempty"`
+	// 篡改响应的第一个字节, 对端一定会解码失败并断开连接
+	CorruptRate float64 `json:",omitempty"`
+	// 不发送响应, 直接关闭连接
+	CloseRate float64 `json:",omitempty"`
+	// 这些方法不会被调用, 直接返回对应的错误码
+	Errors map[string]Code `json:",omitempty"`
+}
+
+// FaultStats counts the faults injected so far.
+type FaultStats struct {
+	Delayed   uint64
+	Closed    uint64
+	Dropped   uint64
+	Reordered uint64
+	Corrupted uint64
+	Errors    uint64
+}
+
+// FaultInjector injects the faults of its current FaultConfig into the
+// connections of a Server. It is safe for concurrent use.
+type FaultInjector struct {
+	mu      sync.RWMutex
+	cfg     FaultConfig
+	methods map[string]bool
+
+	stats FaultStats // 原子操作
+}
+
+func NewFaultInjector(cfg FaultConfig) *FaultInjector {
+	f := &FaultInjector{}
+	f.Set(cfg)
+	return f
+}
+
+// Set replaces the configuration. It applies to responses sent afterwards,
+// on existing connections too.
+func (f *FaultInjector) Set(cfg FaultConfig) {
+	methods := make(map[string]bool, len(cfg.Methods))
+	for _, m := range cfg.Methods {
+		methods[m] = true
+	}
+	cfg.Methods = append([]string(nil), cfg.Methods...) // 调用方之后修改不会影响这里
+	if cfg.Errors != nil {
+		errs := make(map[string]Code, len(cfg.Errors))
+		for m, code := range cfg.Errors {
+			errs[m] = code
+		}
+		cfg.Errors = errs
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg, f.methods = cfg, methods
+}
+
+func (f *FaultInjector) Config() FaultConfig {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cfg
+}
+
+// Reset removes all faults.
+func (f *FaultInjector) Reset() { f.Set(FaultConfig{}) }
+
+func (f *FaultInjector) Stats() FaultStats {
+	return FaultStats{
+		Delayed:   atomic.LoadUint64(&f.stats.Delayed),
+		Closed:    atomic.LoadUint64(&f.stats.Closed),
+		Dropped:   atomic.LoadUint64(&f.stats.Dropped),
+		Reordered: atomic.LoadUint64(&f.stats.Reordered),
+		Corrupted: atomic.LoadUint64(&f.stats.Corrupted),
+		Errors:    atomic.LoadUint64(&f.stats.Errors),
+	}
+}
+
+// 返回 method 要作用的配置, 不受故障影响时返回 false
+func (f *FaultInjector) configFor(method string) (FaultConfig, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.methods) > 0 && !f.methods[method] {
+		return FaultConfig{}, false
+	}
+	return f.cfg, true
+}
+
+func hit(rate float64) bool { return rate > 0 && rand.Float64() < rate }
+
+// methodError 返回给 method 配置的错误, f 为空时返回 nil
+func (f *FaultInjector) methodError(method string) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	code, ok := f.cfg.Errors[method]
+	f.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	atomic.AddUint64(&f.stats.Errors, 1)
+	return Errorf(code, "rpc server: injected fault for %s", method)
+}
+
+// wrap 用 newCodec 在 rwc 上构造 codec, 并在连接和 codec 两层注入故障. f 为空时不做任何包装
+func (f *FaultInjector) wrap(rwc io.ReadWriteCloser, newCodec codec.NewCodecFunc) codec.Codec {
+	if f == nil {
+		return newCodec(rwc)
+	}
+	conn := &faultConn{ReadWriteCloser: rwc}
+	return &faultCodec{Codec: newCodec(conn), f: f, conn: conn}
+}
+
+// 被推迟的响应最多等这么久, 没有下一个响应也会发出去
+const reorderHold = 100 * time.Millisecond
+
+var errFaultClosed = errors.New("rpc server: connection closed by injected fault")
+
+// faultConn 在 corrupt 为 true 时篡改下一次写出的第一个字节, 并统计写出的字节数
+type faultConn struct {
+	io.ReadWriteCloser
+	corrupt bool  // 只在持有 faultCodec.mu 时访问
+	written int64 // 同上
+}
+
+func (c *faultConn) Write(p []byte) (n int, err error) {
+	defer func() { c.written += int64(n) }()
+	if c.corrupt && len(p) > 0 {
+		c.corrupt = false
+		b := append([]byte(nil), p...)
+		b[0] ^= 0xff
+		return c.ReadWriteCloser.Write(b)
+	}
+	return c.ReadWriteCloser.Write(p)
+}
+
+type heldResponse struct {
+	h    codec.Header
+	body interface{}
+	sent func(size int64)
+}
+
+// faultCodec 所有对下层 codec 的写都持有 mu, 和延迟、推迟发送的定时器互斥.
+// 响应可能在 Write 返回之后才写出, 所以实现了 deferredWriter, 真正写出时才报告大小
+type faultCodec struct {
+	codec.Codec
+	f    *FaultInjector
+	conn *faultConn
+
+	mu    sync.Mutex
+	held  *heldResponse
+	timer *time.Timer
+}
+
+var _ deferredWriter = (*faultCodec)(nil)
+
+func (c *faultCodec) Write(h *codec.Header, body interface{}) error {
+	return c.WriteDeferred(h, body, nil)
+}
+
+func (c *faultCodec) WriteDeferred(h *codec.Header, body interface{}, sent func(size int64)) error {
+	cfg, ok := c.f.configFor(h.ServerMethod)
+	if isPong(h) || !ok {
+		return c.write(h, body, false, false, sent)
+	}
+	d := cfg.Latency
+	if cfg.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(cfg.Jitter)))
+	}
+	if d <= 0 {
+		return c.inject(cfg, h, body, sent)
+	}
+	// 不能在这里 sleep: Write 在 sending 锁里调用, 会把后面所有的响应都挡住
+	atomic.AddUint64(&c.f.stats.Delayed, 1)
+	delayed := *h
+	time.AfterFunc(d, func() { _ = c.inject(cfg, &delayed, body, sent) })
+	return nil
+}
+
+// 没有写出的响应, 大小按 0 报告
+func report(sent func(size int64), size int64) {
+	if sent != nil {
+		sent(size)
+	}
+}
+
+// inject 对一个响应依次注入断开、丢弃、乱序和篡改
+func (c *faultCodec) inject(cfg FaultConfig, h *codec.Header, body interface{}, sent func(size int64)) error {
+	if hit(cfg.CloseRate) {
+		atomic.AddUint64(&c.f.stats.Closed, 1)
+		_ = c.Codec.Close()
+		report(sent, 0)
+		return errFaultClosed
+	}
+	if hit(cfg.DropRate) {
+		atomic.AddUint64(&c.f.stats.Dropped, 1)
+		report(sent, 0)
+		return nil
+	}
+	return c.write(h, body, hit(cfg.ReorderRate), hit(cfg.CorruptRate), sent)
+}
+
+// write 在 mu 里写出响应, 释放 mu 之后再报告写出的大小, 报告可能会写访问日志
+func (c *faultCodec) write(h *codec.Header, body interface{}, reorder, corrupt bool, sent func(size int64)) error {
+	c.mu.Lock()
+	if reorder && c.held == nil {
+		atomic.AddUint64(&c.f.stats.Reordered, 1)
+		c.held = &heldResponse{h: *h, body: body, sent: sent}
+		c.timer = time.AfterFunc(reorderHold, c.flushHeld)
+		c.mu.Unlock()
+		return nil
+	}
+	if corrupt {
+		atomic.AddUint64(&c.f.stats.Corrupted, 1)
+		c.conn.corrupt = true
+	}
+	before := c.conn.written
+	err := c.Codec.Write(h, body)
+	size := c.conn.written - before
+	c.conn.corrupt = false
+	held, heldSize := c.held, int64(0)
+	if held != nil { // 被推迟的响应跟在这个响应后面发出
+		c.held = nil
+		c.timer.Stop()
+		before = c.conn.written
+		if herr := c.Codec.Write(&held.h, held.body); err == nil {
+			err = herr
+		}
+		heldSize = c.conn.written - before
+	}
+	c.mu.Unlock()
+	report(sent, size)
+	if held != nil {
+		report(held.sent, heldSize)
+	}
+	return err
+}
+
+func (c *faultCodec) flushHeld() {
+	c.mu.Lock()
+	held := c.held
+	var size int64
+	if held != nil {
+		c.held = nil
+		before := c.conn.written
+		_ = c.Codec.Write(&held.h, held.body)
+		size = c.conn.written - before
+	}
+	c.mu.Unlock()
+	if held != nil {
+		report(held.sent, size)
+	}
+}
+
+type faultsPage struct {
+	Config FaultConfig
+	Stats  FaultStats
+}
+
+// ServeHTTP shows the configuration and statistics on GET, replaces the
+// configuration with the JSON FaultConfig in the body on POST or PUT, and
+// removes all faults on DELETE.
+func (f *FaultInjector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		var cfg FaultConfig
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			http.Error(w, "rpc: invalid fault config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Set(cfg)
+	case http.MethodDelete:
+		f.Reset()
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		http.Error(w, "rpc: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(&faultsPage{Config: f.Config(), Stats: f.Stats()})
+}
+
+// FaultsHandler returns an HTTP handler that shows and changes the fault
+// configuration of the server. It is not authenticated and is never
+// registered by HandleHTTP; mount it only where trusted callers can reach it.
+func (server *Server) FaultsHandler() http.Handler {
+	return faultsHTTP{server}
+}
+
+type faultsHTTP struct {
+	*Server
+}
+
+func (server faultsHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if server.Faults == nil {
+		http.Error(w, "rpc: fault injection is not enabled", http.StatusNotFound)
+		return
+	}
+	server.Faults.ServeHTTP(w, req)
+}
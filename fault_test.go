@@ -0,0 +1,172 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFaultServer(f *FaultInjector) *Server {
+	s := NewServer()
+	var foo Foo
+	var sl Sleeper
+	_ = s.Register(&foo)
+	_ = s.Register(&sl)
+	s.Faults = f
+	return s
+}
+
+func sum(client *Client, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var reply int
+	err := client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	return reply, err
+}
+
+func TestFaultErrorsAndLatency(t *testing.T) {
+	f := NewFaultInjector(FaultConfig{Errors: map[string]Code{"Foo.Sum": Unavailable}})
+	client, cleanup := dialTestServer(newFaultServer(f))
+	defer cleanup()
+
+	_, err := sum(client, time.Second)
+	_assert(CodeOf(err) == Unavailable && strings.Contains(err.Error(), "injected"), "expect Unavailable, got %v", err)
+
+	// 只对其他方法生效
+	f.Set(FaultConfig{Latency: 200 * time.Millisecond, Methods: []string{"Foo.Other"}})
+	reply, err := sum(client, 100*time.Millisecond)
+	_assert(err == nil && reply == 3, "expect no fault, got %d %v", reply, err)
+
+	f.Set(FaultConfig{Latency: 200 * time.Millisecond})
+	_, err = sum(client, 20*time.Millisecond)
+	_assert(CodeOf(err) == DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+
+	// 延迟不占用连接, 其他方法的响应不用排在被延迟的响应后面
+	f.Set(FaultConfig{Latency: 300 * time.Millisecond, Methods: []string{"Foo.Sum"}})
+	var delayed int
+	call := client.Go("Foo.Sum", Args{Num1: 2, Num2: 2}, &delayed, make(chan *Call, 1))
+	start := time.Now()
+	var reply2 int
+	err = client.Call(context.Background(), "Sleeper.Nap", time.Duration(0), &reply2)
+	_assert(err == nil && time.Since(start) < 200*time.Millisecond, "a delayed response blocked the connection: %v %s", err, time.Since(start))
+	<-call.Done
+	_assert(call.Error == nil && delayed == 4 && time.Since(start) >= 250*time.Millisecond, "unexpected delayed call %d %v", delayed, call.Error)
+
+	f.Reset()
+	reply, err = sum(client, time.Second)
+	_assert(err == nil && reply == 3, "call after reset failed: %d %v", reply, err)
+	stats := f.Stats()
+	_assert(stats.Errors == 1 && stats.Delayed == 2, "unexpected stats %+v", stats)
+}
+
+func TestFaultDelayedResponseSize(t *testing.T) {
+	records := &accessRecords{}
+	s := newFaultServer(NewFaultInjector(FaultConfig{Latency: 50 * time.Millisecond}))
+	s.AccessLog = &AccessLog{Sink: records}
+	client, cleanup := dialTestServer(s)
+	defer cleanup()
+
+	reply, err := sum(client, time.Second)
+	_assert(err == nil && reply == 3, "delayed call failed: %d %v", reply, err)
+	recs := records.wait(1)
+	_assert(len(recs) == 1 && recs[0].ResponseSize > 0, "a delayed response must record its size, got %+v", recs)
+	_assert(recs[0].Duration >= 50*time.Millisecond, "the record must be written after the delayed response, got %s", recs[0].Duration)
+
+	// 乱序推迟的响应跟着下一个响应写出, 两个都要记录大小
+	s.Faults.Set(FaultConfig{ReorderRate: 1})
+	calls := []*Call{
+		client.Go("Foo.Sum", Args{Num1: 1, Num2: 1}, new(int), make(chan *Call, 1)),
+		client.Go("Foo.Sum", Args{Num1: 2, Num2: 2}, new(int), make(chan *Call, 1)),
+	}
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "reordered call failed: %v", call.Error)
+	}
+	recs = records.wait(3)
+	_assert(len(recs) == 3, "expect 3 records, got %+v", recs)
+	for _, r := range recs {
+		_assert(r.ResponseSize > 0, "a reordered response must record its size, got %+v", r)
+	}
+}
+
+func TestFaultDropAndReorder(t *testing.T) {
+	f := NewFaultInjector(FaultConfig{DropRate: 1})
+	client, cleanup := dialTestServer(newFaultServer(f))
+	defer cleanup()
+
+	_, err := sum(client, 50*time.Millisecond)
+	_assert(CodeOf(err) == DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+	_assert(f.Stats().Dropped == 1, "unexpected stats %+v", f.Stats())
+
+	// 第一个响应被推迟, 跟在第二个响应后面到达
+	f.Set(FaultConfig{ReorderRate: 1})
+	var first, second int
+	call1 := client.Go("Foo.Sum", Args{Num1: 1, Num2: 1}, &first, make(chan *Call, 1))
+	for deadline := time.Now().Add(time.Second); f.Stats().Reordered == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first response was never held")
+		}
+	}
+	call2 := client.Go("Foo.Sum", Args{Num1: 2, Num2: 2}, &second, make(chan *Call, 1))
+	select {
+	case <-call1.Done:
+		t.Fatal("the held response arrived first")
+	case <-call2.Done:
+	}
+	<-call1.Done
+	_assert(call1.Error == nil && first == 2 && call2.Error == nil && second == 4, "unexpected replies %d %d", first, second)
+
+	// 后面没有响应时, 被推迟的响应最终也会发出
+	reply, err := sum(client, time.Second)
+	_assert(err == nil && reply == 3, "held response lost: %d %v", reply, err)
+}
+
+func TestFaultBreaksConnection(t *testing.T) {
+	for _, cfg := range []FaultConfig{{CorruptRate: 1}, {CloseRate: 1}} {
+		f := NewFaultInjector(cfg)
+		client, cleanup := dialTestServer(newFaultServer(f))
+		_, err := sum(client, time.Second)
+		_assert(err != nil && CodeOf(err) != DeadlineExceeded, "%+v: expect the connection to fail, got %v", cfg, err)
+		_, err = sum(client, time.Second)
+		_assert(errors.Is(err, ErrShutDown), "%+v: expect the client to be shut down, got %v", cfg, err)
+		stats := f.Stats()
+		_assert(stats.Corrupted+stats.Closed == 1, "unexpected stats %+v", stats)
+		cleanup()
+	}
+}
+
+func TestFaultHTTP(t *testing.T) {
+	do := func(s *Server, method, body string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.FaultsHandler().ServeHTTP(rec, httptest.NewRequest(method, "/faults", strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+	code, _ := do(NewServer(), "GET", "")
+	_assert(code == 404, "expect 404 without an injector, got %d", code)
+
+	f := NewFaultInjector(FaultConfig{})
+	s := newFaultServer(f)
+	code, body := do(s, "POST", `{"DropRate": 0.5, "Errors": {"Foo.Sum": 14}}`)
+	_assert(code == 200 && strings.Contains(body, `"DropRate": 0.5`), "unexpected response %d %s", code, body)
+	cfg := f.Config()
+	_assert(cfg.DropRate == 0.5 && cfg.Errors["Foo.Sum"] == Unavailable, "config not applied: %+v", cfg)
+	code, _ = do(s, "POST", `{"DropRat": 1}`)
+	_assert(code == 400, "expect 400 for an unknown field, got %d", code)
+	code, body = do(s, "DELETE", "")
+	_assert(code == 200 && !strings.Contains(body, "DropRate"), "unexpected response %d %s", code, body)
+	code, _ = do(s, "PATCH", "")
+	_assert(code == 405, "expect 405, got %d", code)
+}
+
+func TestHandleHTTP_NoFaults(t *testing.T) {
+	s := NewServer()
+	s.Faults = NewFaultInjector(FaultConfig{})
+	s.HandleHTTP()
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", defaultDebugPath+"/faults", strings.NewReader(`{"DropRate":1}`)))
+	_assert(s.Faults.Config().DropRate == 0, "HandleHTTP must not expose the fault injector")
+}
@@ -0,0 +1,74 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+注册普通函数, 不需要定义一个结构体:
+
+	server.RegisterFunc("Math.Add", func(ctx context.Context, args Args, reply *int) error { ... })
+
+"Math" 是服务名, "Add" 是方法名. 同一个服务名下可以注册多个函数,
+但是不能和通过 Register 注册的服务重名. 函数的签名检查和结构体的方法一样.
+*/
+
+// RegisterFunc publishes fn as serviceMethod ("Service.Method"). fn must
+// have the signature func(args, *reply) error or
+// func(ctx context.Context, args, *reply) error. opts apply to fn only.
+func (s *Server) RegisterFunc(serviceMethod string, fn interface{}, opts ...ServiceOption) error {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot <= 0 || dot == len(serviceMethod)-1 {
+		return fmt.Errorf("rpc server: func name %q is not of the form Service.Method", serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("rpc server: %s: %T is not a function", serviceMethod, fn)
+	}
+	argType, replyType, withCtx, err := checkMethod(fv.Type(), 0)
+	if err != nil {
+		return fmt.Errorf("rpc server: %s: func %s", serviceMethod, err)
+	}
+	m := &methodType{ArgType: argType, ReplyType: replyType, withCtx: withCtx, fn: fv}
+
+	// 先用一个只有这个函数的临时服务应用配置, 不会影响同一个服务下的其他函数
+	tmp := &service{name: serviceName, method: map[string]*methodType{methodName: m}}
+	if err := tmp.apply(newServiceOptions(opts)); err != nil {
+		return err
+	}
+
+	svci, loaded := s.serviceMap.LoadOrStore(serviceName, &service{name: serviceName, funcs: true, method: tmp.method})
+	if !loaded {
+		return nil
+	}
+	svc := svci.(*service)
+	if !svc.funcs {
+		return errors.New("rpc: serivce already defined: " + serviceName)
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.closed {
+		return errors.New("rpc: serivce is being unregistered: " + serviceName)
+	}
+	if _, dup := svc.method[methodName]; dup {
+		return errors.New("rpc: method already defined: " + serviceMethod)
+	}
+	svc.method[methodName] = m
+	return nil
+}
+
+func RegisterFunc(serviceMethod string, fn interface{}, opts ...ServiceOption) error {
+	return DefaultServer.RegisterFunc(serviceMethod, fn, opts...)
+}
+
+// RegisterTypedFunc is a type-safe RegisterFunc: the signature of fn is
+// checked by the compiler instead of at registration time.
+func RegisterTypedFunc[Args any, Reply any](s *Server, serviceMethod string,
+	fn func(ctx context.Context, args Args, reply *Reply) error, opts ...ServiceOption) error {
+	return s.RegisterFunc(serviceMethod, fn, opts...)
+}
@@ -0,0 +1,44 @@
+package tearpc
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_RegisterFunc(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterFunc("Math.Add", func(args Args, reply *int) error {
+		*reply = args.Num1 + args.Num2
+		return nil
+	})
+	_assert(err == nil, "register Math.Add: %v", err)
+	err = RegisterTypedFunc(s, "Math.Mul", func(ctx context.Context, args Args, reply *int) error {
+		*reply = args.Num1 * args.Num2
+		return nil
+	})
+	_assert(err == nil, "register Math.Mul: %v", err)
+
+	_assert(s.RegisterFunc("Math.Add", func(Args, *int) error { return nil }) != nil, "duplicate funcs must be rejected")
+	_assert(s.RegisterFunc("Math.Bad", func(Args, int) error { return nil }) != nil, "reply must be a pointer")
+	_assert(s.RegisterFunc("Math.Bad", func(Args, *int) {}) != nil, "funcs must return an error")
+	_assert(s.RegisterFunc("NoDot", func(Args, *int) error { return nil }) != nil, "names need a service part")
+	var foo Foo
+	_ = s.Register(&foo)
+	_assert(s.RegisterFunc("Foo.Extra", func(Args, *int) error { return nil }) != nil,
+		"funcs can't be added to a reflected service")
+
+	client, done := dialTestServer(s)
+	defer done()
+	var reply int
+	err = client.Call(context.Background(), "Math.Add", Args{2, 3}, &reply)
+	_assert(err == nil && reply == 5, "Math.Add: %d, %v", reply, err)
+	err = client.Call(context.Background(), "Math.Mul", Args{2, 3}, &reply)
+	_assert(err == nil && reply == 6, "Math.Mul: %d, %v", reply, err)
+
+	w := httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "Math (functions)") && strings.Contains(w.Body.String(), "Mul("),
+		"debug page should list the funcs")
+}
@@ -0,0 +1,169 @@
+package tearpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+心跳: 半开的 TCP 连接上, receive 会一直阻塞在 ReadHeader, 只有设置了超时的调用才会失败.
+1、客户端每隔 HeartbeatInterval 发送一个 ping 帧, 服务端收到后马上回一个 pong 帧
+2、客户端超过 HeartbeatTimeout 没有收到任何数据, 写也没有任何进展, 就认为连接已经断了, 关闭连接并让所有等待中的调用失败.
+   连接支持读超时(net.Conn)时, 每次读都设置 HeartbeatTimeout 的读超时, 半开的连接上读会直接失败;
+   心跳循环里的检查用于不支持读超时的连接.
+   发送大的请求时心跳排不上, 也就收不到 pong, 所以大的请求每写出一块也重新计时, 见 progressConn
+3、服务端超过 IdleTimeout 没有任何数据往来(并且没有正在处理的请求), 就关闭连接
+
+ping/pong 帧的 Seq 为 0, 客户端的序列号从 1 开始, 不会冲突
+*/
+
+const (
+	heartbeatPing = "_tearpc.Ping"
+	heartbeatPong = "_tearpc.Pong"
+)
+
+// ErrHeartbeatTimeout fails the pending calls of a client whose server
+// stopped answering heartbeats.
+var ErrHeartbeatTimeout = errors.New("rpc client: heartbeat timeout")
+
+func isPing(h *codec.Header) bool { return h.Seq == 0 && h.ServerMethod == heartbeatPing }
+
+func isPong(h *codec.Header) bool { return h.Seq == 0 && h.ServerMethod == heartbeatPong }
+
+// 客户端超过这个时间没有收到数据就断开连接, 默认是3个心跳周期
+func (opt *Option) heartbeatTimeout() time.Duration {
+	if opt.HeartbeatTimeout > 0 {
+		return opt.HeartbeatTimeout
+	}
+	return 3 * opt.HeartbeatInterval
+}
+
+// active 在收到数据或者写出有进展时调用, 重新开始计算心跳超时
+func (c *Client) active() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	c.setReadDeadline()
+}
+
+// progressWriteChunk 写被拆成的块的大小, 每写完一块就重新计时
+const progressWriteChunk = 32 << 10
+
+// progressConn 开启心跳时包在客户端的连接外面, 把大的写拆成小块, 写出一块就调用一次 active.
+// 对端一直在读的连接不会因为一个很大的请求被当成断开; 写完全阻塞(比如半开连接的发送缓冲区满了)时照样超时.
+// 不超过一块的写(心跳和小的请求)不计时: 它们写进发送缓冲区就返回了, 说明不了对端还活着
+type progressConn struct {
+	net.Conn
+	client *Client // newClientCodec 里设置, 之前的写(option)不计时
+}
+
+func (p *progressConn) Write(b []byte) (n int, err error) {
+	if len(b) <= progressWriteChunk || p.client == nil {
+		return p.Conn.Write(b)
+	}
+	for len(b) > 0 && err == nil {
+		chunk := b
+		if len(chunk) > progressWriteChunk {
+			chunk = chunk[:progressWriteChunk]
+		}
+		var m int
+		m, err = p.Conn.Write(chunk)
+		n, b = n+m, b[m:]
+		if m > 0 {
+			p.client.active()
+		}
+	}
+	return n, err
+}
+
+// setReadDeadline 开启心跳时给下一次读设置超时
+func (c *Client) setReadDeadline() {
+	if c.conn != nil && c.opt.HeartbeatInterval > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.opt.heartbeatTimeout()))
+	}
+}
+
+// 客户端的心跳循环, 连接断开(receive 退出)时结束
+func (c *Client) heartbeat() {
+	ticker := time.NewTicker(c.opt.HeartbeatInterval)
+	defer ticker.Stop()
+	timeout := c.opt.heartbeatTimeout()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive))) > timeout {
+			c.fail(ErrHeartbeatTimeout)
+			return
+		}
+		// 正在发送请求时跳过这次心跳, 不要排在大的请求后面阻塞心跳循环
+		if !c.sending.TryLock() {
+			continue
+		}
+		err := c.cc.Write(&codec.Header{ServerMethod: heartbeatPing}, invalidRequest)
+		c.sending.Unlock()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// fail 记录失败原因并关闭连接, receive 退出后用这个原因结束所有等待中的调用
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	if c.failErr == nil {
+		c.failErr = err
+	}
+	c.mu.Unlock()
+	_ = c.cc.Close()
+}
+
+// serverConnState 记录一个连接最近的活动, 用来检测空闲连接; 调试页面也从这里读取连接的信息
+type serverConnState struct {
+	lastActive int64 // unix nano
+	inflight   int64
+
+	id    uint64
+	peer  *Peer
+	codec codec.Type
+	since time.Time
+	conn  *countingConn
+
+	mu       sync.Mutex
+	requests map[*request]time.Time // 正在处理的请求 -> 开始时间
+}
+
+func (st *serverConnState) touch() { atomic.StoreInt64(&st.lastActive, time.Now().UnixNano()) }
+
+func (st *serverConnState) idle(timeout time.Duration) bool {
+	if atomic.LoadInt64(&st.inflight) > 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&st.lastActive))) > timeout
+}
+
+// 服务端的空闲检测, done 关闭时(连接已经退出)结束
+func (s *Server) watchIdle(cc codec.Codec, st *serverConnState, done <-chan struct{}) {
+	interval := s.IdleTimeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if st.idle(s.IdleTimeout) {
+				_ = cc.Close() // 读请求的循环会因为读失败而退出
+				return
+			}
+		}
+	}
+}
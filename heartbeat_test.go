@@ -0,0 +1,116 @@
+package tearpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient_HeartbeatTimeout(t *testing.T) {
+	// 模拟一个半开的连接: 读走所有数据, 但是从来不回复
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{HeartbeatInterval: 20 * time.Millisecond})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ch := make(chan error, 1)
+	go func() {
+		var reply int
+		ch <- client.Call(context.Background(), "Foo.Sum", Args{1, 2}, &reply)
+	}()
+	select {
+	case err := <-ch:
+		_assert(errors.Is(err, ErrHeartbeatTimeout), "expect heartbeat timeout, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("call was not failed by the heartbeat")
+	}
+}
+
+func TestClient_HeartbeatTimeoutWhileWriting(t *testing.T) {
+	// 对端读完 option 之后就不再读, 请求会一直阻塞在写上, 并且占着发送锁
+	conn, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	go func() { _, _ = bufio.NewReader(server).ReadString('\n') }()
+
+	opt := *DefaultOption
+	opt.HeartbeatInterval = 20 * time.Millisecond
+	client, err := NewClient(conn, &opt)
+	_assert(err == nil, "new client failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ch := make(chan error, 1)
+	go func() {
+		var reply int
+		ch <- client.Call(context.Background(), "Foo.Sum", Args{1, 2}, &reply)
+	}()
+	select {
+	case err := <-ch:
+		_assert(errors.Is(err, ErrHeartbeatTimeout), "expect heartbeat timeout, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("a blocked write hid the heartbeat timeout")
+	}
+}
+
+// slowConn 每次最多读 4KB, 每次读之前先等一会儿, 模拟一个慢但是一直在读的对端
+type slowConn struct{ net.Conn }
+
+func (c slowConn) Read(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	if len(p) > 4<<10 {
+		p = p[:4<<10]
+	}
+	return c.Conn.Read(p)
+}
+
+func TestClient_HeartbeatLongUpload(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(Store(0))
+	conn, server := net.Pipe()
+	go s.ServeConn(slowConn{server})
+
+	opt := *DefaultOption
+	opt.HeartbeatInterval = 20 * time.Millisecond
+	client, err := NewClient(conn, &opt)
+	_assert(err == nil, "new client failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 按服务端读的速度, 这个请求要写好几个心跳超时那么久
+	key := strings.Repeat("k", 1<<20)
+	start := time.Now()
+	var reply string
+	err = client.Call(context.Background(), "Store.Get", key, &reply)
+	_assert(CodeOf(err) == NotFound, "a slow upload must not be failed by the heartbeat, got %v", err)
+	_assert(time.Since(start) > 3*opt.heartbeatTimeout(), "the upload was too fast to test anything: %s", time.Since(start))
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(&foo)
+	s.IdleTimeout = 100 * time.Millisecond
+
+	idle, done := dialTestServer(s)
+	defer done()
+	alive, done2 := dialTestServer(s, &Option{HeartbeatInterval: 20 * time.Millisecond})
+	defer done2()
+
+	time.Sleep(300 * time.Millisecond)
+	var reply int
+	err := idle.Call(context.Background(), "Foo.Sum", Args{1, 2}, &reply)
+	_assert(err != nil, "idle connection should have been closed")
+	err = alive.Call(context.Background(), "Foo.Sum", Args{1, 2}, &reply)
+	_assert(err == nil && reply == 3, "heartbeats should keep the connection open, got %v", err)
+}
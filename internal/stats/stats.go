@@ -0,0 +1,148 @@
+// Package stats drives concurrent calls and summarizes their latencies for
+// the command-line load generators.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 最多保留这么多个耗时样本, 长时间压测的内存不会一直涨
+var maxSamples = 100000
+
+// Result is the outcome of a Load run.
+type Result struct {
+	Calls       int
+	Concurrency int
+	Elapsed     time.Duration
+	// OK 是成功调用的次数, Min 和 Max 是其中最短和最长的耗时
+	OK       int
+	Min, Max time.Duration
+	// Latencies 是成功调用耗时的均匀抽样(蓄水池抽样), 最多 maxSamples 个, 从小到大排好序.
+	// 成功的调用不超过 maxSamples 个时就是全部的耗时
+	Latencies []time.Duration
+	// Errors 按 classify 的结果统计失败的调用
+	Errors map[string]int
+}
+
+// Load calls fn from workers goroutines, n times in total. When d > 0 it
+// stops after d instead, and n limits the calls only if it is positive.
+// classify names the kind of each error, e.g. its status code.
+func Load(n, workers int, d time.Duration, fn func() error, classify func(error) string) *Result {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		mu  sync.Mutex
+		res = &Result{Concurrency: workers, Errors: make(map[string]int)}
+		wg  sync.WaitGroup
+	)
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	// 每个 worker 调用之前先领一个号, 领完或者到时间就退出
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if (n > 0 || d <= 0) && res.Calls >= n {
+			return false
+		}
+		if d > 0 && !time.Now().Before(deadline) {
+			return false
+		}
+		res.Calls++
+		return true
+	}
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next() {
+				t := time.Now()
+				err := fn()
+				elapsed := time.Since(t)
+				mu.Lock()
+				if err != nil {
+					res.Errors[classify(err)]++
+				} else {
+					res.add(elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	sort.Slice(res.Latencies, func(i, j int) bool { return res.Latencies[i] < res.Latencies[j] })
+	return res
+}
+
+// add 记录一次成功调用的耗时. 样本满了之后, 第 k 个耗时以 maxSamples/k 的概率替换一个旧样本
+func (r *Result) add(d time.Duration) {
+	r.OK++
+	if r.OK == 1 || d < r.Min {
+		r.Min = d
+	}
+	if d > r.Max {
+		r.Max = d
+	}
+	if len(r.Latencies) < maxSamples {
+		r.Latencies = append(r.Latencies, d)
+		return
+	}
+	if i := rand.Intn(r.OK); i < maxSamples {
+		r.Latencies[i] = d
+	}
+}
+
+func (r *Result) Failed() int { return r.Calls - r.OK }
+
+func (r *Result) QPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Calls) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of the successful
+// calls fall, 0 when there were none. Long runs estimate it from a sample.
+func (r *Result) Percentile(p int) time.Duration {
+	return Percentile(r.Latencies, p)
+}
+
+// Percentile returns the p-th percentile of sorted, which must be in
+// ascending order (nearest-rank method).
+func Percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Print writes a human-readable summary of r to w.
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "calls: %d, ok: %d, errors: %d, concurrency: %d\n", r.Calls, r.OK, r.Failed(), r.Concurrency)
+	fmt.Fprintf(w, "elapsed: %s, qps: %.1f\n", r.Elapsed.Round(time.Millisecond), r.QPS())
+	if r.OK > 0 {
+		fmt.Fprintf(w, "latency: min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+			r.Min, r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Max)
+	}
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "error %s: %d\n", kind, r.Errors[kind])
+	}
+}
@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	var calls int64
+	res := Load(100, 8, 0, func() error {
+		if atomic.AddInt64(&calls, 1)%10 == 0 {
+			return errors.New("boom")
+		}
+		return nil
+	}, func(err error) string { return err.Error() })
+	if res.Calls != 100 || calls != 100 || len(res.Latencies) != 90 || res.Errors["boom"] != 10 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	var out bytes.Buffer
+	res.Print(&out)
+	for _, want := range []string{"calls: 100, ok: 90, errors: 10, concurrency: 8", "p99", "error boom: 10"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expect %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadDuration(t *testing.T) {
+	res := Load(0, 2, 30*time.Millisecond, func() error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}, nil)
+	if res.Calls == 0 || res.Elapsed < 30*time.Millisecond || res.Failed() != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res := Load(5, 2, time.Second, func() error { return nil }, nil); res.Calls != 5 {
+		t.Fatalf("n must still limit a timed run, got %d calls", res.Calls)
+	}
+}
+
+func TestLoadSamples(t *testing.T) {
+	defer func(n int) { maxSamples = n }(maxSamples)
+	maxSamples = 10
+	res := Load(1000, 4, 0, func() error { return nil }, nil)
+	if res.OK != 1000 || res.Failed() != 0 || len(res.Latencies) != 10 {
+		t.Fatalf("expect 1000 ok calls and 10 samples, got %d ok, %d samples", res.OK, len(res.Latencies))
+	}
+	if res.Min > res.Latencies[0] || res.Max < res.Latencies[9] {
+		t.Fatalf("min %s and max %s must cover the samples %v", res.Min, res.Max, res.Latencies)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for p, want := range map[int]time.Duration{0: 1, 50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := Percentile(sorted, p); got != want {
+			t.Fatalf("p%d = %d, want %d", p, got, want)
+		}
+	}
+	if Percentile(nil, 50) != 0 {
+		t.Fatal("expect 0 without samples")
+	}
+}
@@ -0,0 +1,41 @@
+package tearpc
+
+import (
+	"context"
+	"log/slog"
+)
+
+/*
+日志: 服务端用 Server.Logger, 客户端用 Option.Logger, 都是 *slog.Logger, 为空时不输出任何日志.
+每个请求相关的日志都带上 seq, method 和 peer 字段. 热路径(收发每个请求)上只有 Debug 级别的日志
+
+	server.Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+*/
+
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler 丢弃所有日志, Enabled 返回 false, 调用方连参数都不用格式化
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+func loggerOrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discardLogger
+	}
+	return l
+}
+
+func (s *Server) logger() *slog.Logger { return loggerOrDiscard(s.Logger) }
+
+// 请求相关的日志带上 seq, method 和 peer
+func (req *request) logger(l *slog.Logger) *slog.Logger {
+	l = l.With("seq", req.Header.Seq, "method", req.Header.ServerMethod)
+	if p, ok := PeerFromContext(req.ctx); ok && p.Addr != nil {
+		l = l.With("peer", p.Addr.String())
+	}
+	return l
+}
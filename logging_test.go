@@ -0,0 +1,75 @@
+package tearpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer 服务端和客户端的 goroutine 会同时写日志
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records 返回 msg 为 msg 的所有日志
+func (b *syncBuffer) records(msg string) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var r map[string]interface{}
+		if json.Unmarshal([]byte(line), &r) == nil && r["msg"] == msg {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type Chatty int
+
+func (c Chatty) Hello(_ int, reply *string) error { *reply = "hello"; return nil }
+
+func (c Chatty) Shout(s string) string { return strings.ToUpper(s) }
+
+func TestLogging(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	s := NewServer()
+	s.Logger = logger
+	var l Lifecycle
+	_ = s.Register(&l)
+	_ = s.Register(new(Chatty))
+	client, cleanup := dialTestServer(s)
+	defer cleanup()
+
+	var reply int
+	err := client.Call(context.Background(), "Lifecycle.Panic", 0, &reply)
+	_assert(CodeOf(err) == Internal, "expect Internal, got %v", err)
+	panics := logs.records("rpc server: method panicked")
+	_assert(len(panics) == 1, "expect one panic record, got %s", logs.buf.String())
+	r := panics[0]
+	_assert(r["level"] == "ERROR" && r["method"] == "Lifecycle.Panic" && r["seq"] == float64(1) && r["panic"] == "boom",
+		"unexpected record %v", r)
+	_assert(strings.HasPrefix(r["peer"].(string), "127.0.0.1:"), "expect the peer address, got %v", r["peer"])
+
+	_ = client.Call(context.Background(), "Lifecycle.Nope", 0, &reply)
+	rejected := logs.records("rpc server: request rejected")
+	_assert(len(rejected) == 1 && rejected[0]["method"] == "Lifecycle.Nope", "unexpected records %v", rejected)
+	_assert(len(logs.records("rpc server: skipped method")) > 0, "expect skipped methods to be logged")
+
+	// 默认不输出任何日志
+	_assert(!discardLogger.Enabled(context.Background(), slog.LevelError), "default logger must be silent")
+	_assert(NewServer().logger() == discardLogger, "expect the silent default")
+}
@@ -0,0 +1,64 @@
+package tearpc
+
+import "context"
+
+/*
+元数据: 随请求一起发送的 key/value, 放在 Header.Meta 中
+客户端: ctx = tearpc.WithMetadata(ctx, map[string]string{"x-request-id": "42"}); client.Call(ctx, ...)
+服务端: 方法的第一个参数为 context.Context 时, tearpc.MetadataFromContext(ctx) 读取收到的元数据
+收到的元数据和要发送的元数据使用不同的 key, 服务端把 ctx 传给下游调用时不会把元数据(比如认证信息)原样转发出去
+*/
+
+type outgoingMetaKey struct{}
+
+type incomingMetaKey struct{}
+
+// WithMetadata returns a context whose Client.Call sends md along with the
+// request, merged over metadata already attached to ctx.
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	merged := make(map[string]string)
+	for k, v := range outgoingMetadata(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingMetaKey{}, merged)
+}
+
+func outgoingMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(outgoingMetaKey{}).(map[string]string)
+	return md
+}
+
+// MetadataFromContext returns the metadata received with the request
+// being handled. The map must not be modified.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(incomingMetaKey{}).(map[string]string)
+	return md
+}
+
+func withIncomingMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, incomingMetaKey{}, md)
+}
+
+// 合并两份元数据, b 覆盖 a
+func mergeMetadata(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	md := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		md[k] = v
+	}
+	for k, v := range b {
+		md[k] = v
+	}
+	return md
+}
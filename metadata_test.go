@@ -0,0 +1,36 @@
+package tearpc
+
+import (
+	"context"
+	"testing"
+)
+
+type Echo int
+
+// Meta 返回收到的元数据
+func (e Echo) Meta(ctx context.Context, _ int, reply *map[string]string) error {
+	*reply = MetadataFromContext(ctx)
+	return nil
+}
+
+func TestMetadata(t *testing.T) {
+	s := NewServer()
+	var e Echo
+	_ = s.Register(&e)
+	s.Authenticator = NewTokenAuth(map[string]string{"secret": "alice"})
+	opt := *DefaultOption
+	opt.Credentials = TokenCredentials("secret")
+	client, cleanup := dialTestServer(s, &opt)
+	defer cleanup()
+
+	ctx := WithMetadata(context.Background(), map[string]string{"x-request-id": "42", "lang": "go"})
+	ctx = WithMetadata(ctx, map[string]string{"lang": "zh"})
+	var md map[string]string
+	err := client.Call(ctx, "Echo.Meta", 0, &md)
+	_assert(err == nil, "call failed: %v", err)
+	_assert(len(md) == 2 && md["x-request-id"] == "42" && md["lang"] == "zh", "unexpected metadata %v", md)
+
+	md = nil
+	err = client.Call(context.Background(), "Echo.Meta", 0, &md)
+	_assert(err == nil && len(md) == 0, "expect no metadata, got %v %v", md, err)
+}
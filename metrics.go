@@ -0,0 +1,495 @@
+package tearpc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+指标, 以 Prometheus 文本格式输出:
+- 服务端(每个 Server 一份): 按 service/method 统计的请求数(按状态码)、耗时直方图、正在处理的请求数,
+  以及连接数、握手失败次数、收发字节数
+- 客户端(整个进程一份): 按目标地址统计同样的内容, 目标地址是 Dial 时传入的地址
+
+HandleHTTP 会把 defaultMetricsPath 一起注册上, 同时输出服务端和客户端的指标.
+字节数在 codec 之下统计, 包括 header 和心跳; TLS 连接统计的是解密后的数据
+*/
+
+const defaultMetricsPath = "/debug/geerpc/metrics"
+
+// 耗时直方图的桶, 单位为秒
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // 每个桶单独计数, 输出时再累加
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// methodStats 是一个方法的统计, 由所属的 serverMetrics/targetStats 的锁保护
+type methodStats struct {
+	inflight int64
+	codes    map[Code]uint64
+	latency  histogram
+}
+
+// clone 拷贝一份统计, 输出的时候不用一直持有锁
+func (st *methodStats) clone() *methodStats {
+	c := *st
+	c.codes = make(map[Code]uint64, len(st.codes))
+	for code, n := range st.codes {
+		c.codes[code] = n
+	}
+	c.latency.counts = append([]uint64(nil), st.latency.counts...)
+	return &c
+}
+
+type methodKey struct{ service, method string }
+
+// 未知的方法统一记在 unknown 下面, 避免客户端随便传方法名让指标无限增长
+var unknownMethod = methodKey{"unknown", "unknown"}
+
+func splitMethod(serviceMethod string) methodKey {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return methodKey{method: serviceMethod}
+	}
+	return methodKey{serviceMethod[:dot], serviceMethod[dot+1:]}
+}
+
+type serverMetrics struct {
+	mu                sync.Mutex
+	methods           map[methodKey]*methodStats
+	handshakeFailures map[string]uint64 // 失败原因 -> 次数
+
+	connections      int64 // 原子操作
+	connectionsTotal uint64
+	receivedBytes    uint64
+	sentBytes        uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{methods: make(map[methodKey]*methodStats), handshakeFailures: make(map[string]uint64)}
+}
+
+// loadMetrics 在第一次用到时才创建指标, 这样零值的 Server 也能直接使用
+func (s *Server) loadMetrics() *serverMetrics {
+	s.metricsOnce.Do(func() { s.metrics = newServerMetrics() })
+	return s.metrics
+}
+
+// 调用方持有 m.mu
+func (m *serverMetrics) stats(k methodKey) *methodStats {
+	st, ok := m.methods[k]
+	if !ok {
+		st = &methodStats{codes: make(map[Code]uint64)}
+		m.methods[k] = st
+	}
+	return st
+}
+
+// begin 标记一个请求开始处理
+func (m *serverMetrics) begin(k methodKey) {
+	m.mu.Lock()
+	m.stats(k).inflight++
+	m.mu.Unlock()
+}
+
+// end 记录一个处理完的请求
+func (m *serverMetrics) end(k methodKey, code Code, d time.Duration) {
+	m.mu.Lock()
+	st := m.stats(k)
+	st.inflight--
+	st.codes[code]++
+	st.latency.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// reject 记录一个没有进入处理流程就失败的请求, 比如认证失败、限流、找不到方法
+func (m *serverMetrics) reject(k methodKey, code Code) {
+	m.mu.Lock()
+	m.stats(k).codes[code]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) handshakeFailed(reason string) {
+	m.mu.Lock()
+	m.handshakeFailures[reason]++
+	m.mu.Unlock()
+}
+
+// countingConn 统计经过连接的字节数, 同时累加到 in/out 指向的总数上.
+// 它是字节数唯一的来源: 指标、调试页面, 以及 span 和访问日志里每个消息的大小都从这里读.
+// 读经过 r 并且实现了 io.ByteReader, gob 解码器就不会再套一层自己的缓冲区预读, 统计的是解码器实际消费的字节数.
+// json 解码器总会预读, 用 json 编码时每个消息的大小是近似值
+type countingConn struct {
+	io.ReadWriteCloser
+	r             *bufio.Reader
+	pending       []byte // 放回来的数据, 读到时才计数
+	in, out       *uint64
+	read, written uint64
+}
+
+func newCountingConn(rwc io.ReadWriteCloser, in, out *uint64) *countingConn {
+	return &countingConn{ReadWriteCloser: rwc, r: bufio.NewReader(rwc), in: in, out: out}
+}
+
+func (c *countingConn) countRead(n int) {
+	atomic.AddUint64(c.in, uint64(n))
+	atomic.AddUint64(&c.read, uint64(n))
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		c.countRead(n)
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	c.countRead(n)
+	return n, err
+}
+
+func (c *countingConn) ReadByte() (byte, error) {
+	if len(c.pending) > 0 {
+		b := c.pending[0]
+		c.pending = c.pending[1:]
+		c.countRead(1)
+		return b, nil
+	}
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.countRead(1)
+	}
+	return b, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(c.out, uint64(n))
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// c 为空时(不经过 ServeConn 的请求)返回 0
+func (c *countingConn) bytesRead() int64 {
+	if c == nil {
+		return 0
+	}
+	return int64(atomic.LoadUint64(&c.read))
+}
+
+func (c *countingConn) bytesWritten() int64 {
+	if c == nil {
+		return 0
+	}
+	return int64(atomic.LoadUint64(&c.written))
+}
+
+// WriteMetrics writes the metrics of s in the Prometheus text format.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	m := s.loadMetrics()
+	mw := &metricWriter{w: w}
+	mw.gauge("tearpc_server_connections", "Open connections.", nil, float64(atomic.LoadInt64(&m.connections)))
+	mw.counter("tearpc_server_connections_total", "Accepted connections.", nil, float64(atomic.LoadUint64(&m.connectionsTotal)))
+	mw.counter("tearpc_server_received_bytes_total", "Bytes read from clients.", nil, float64(atomic.LoadUint64(&m.receivedBytes)))
+	mw.counter("tearpc_server_sent_bytes_total", "Bytes written to clients.", nil, float64(atomic.LoadUint64(&m.sentBytes)))
+
+	m.mu.Lock()
+	failures := make(map[string]uint64, len(m.handshakeFailures))
+	reasons := make([]string, 0, len(m.handshakeFailures))
+	for r, n := range m.handshakeFailures {
+		failures[r] = n
+		reasons = append(reasons, r)
+	}
+	keys := make([]methodKey, 0, len(m.methods))
+	for k := range m.methods {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].method < keys[j].method
+	})
+	stats := make([]*methodStats, len(keys))
+	labels := make([][]string, len(keys))
+	for i, k := range keys {
+		stats[i], labels[i] = m.methods[k].clone(), []string{"service", k.service, "method", k.method}
+	}
+	m.mu.Unlock()
+
+	sort.Strings(reasons)
+	mw.help("tearpc_server_handshake_failures_total", "counter", "Connections rejected during the handshake, by reason.")
+	for _, r := range reasons {
+		mw.sample("tearpc_server_handshake_failures_total", []string{"reason", r}, float64(failures[r]))
+	}
+	mw.methods("tearpc_server", "requests", stats, labels)
+	return mw.err
+}
+
+// clientMetrics 是进程内所有客户端的指标, 按目标地址区分.
+// 最多保存 maxClientTargets 个目标, 满了以后删掉一个没有被引用的目标, 都有引用时新的目标记在 otherTarget 下面.
+// 客户端和正在进行的 dial 会一直引用自己的目标, 它们的指标不会在使用中被删掉
+var clientMetrics = struct {
+	mu      sync.Mutex
+	targets map[string]*targetStats
+}{targets: make(map[string]*targetStats)}
+
+type targetStats struct {
+	name              string
+	refs              int   // 引用这个目标的客户端和 dial 的个数, clientMetrics.mu 保护
+	connections       int64 // 原子操作
+	dialFailures      uint64
+	handshakeFailures uint64
+	sentBytes         uint64
+	receivedBytes     uint64
+
+	mu      sync.Mutex
+	methods map[string]*methodStats
+}
+
+const (
+	maxClientTargets = 256
+	otherTarget      = "other"
+)
+
+// acquireTarget 返回 target 的指标并增加引用计数, 不再使用时调用 release
+func acquireTarget(target string) *targetStats {
+	clientMetrics.mu.Lock()
+	defer clientMetrics.mu.Unlock()
+	targets := clientMetrics.targets
+	t, ok := targets[target]
+	if !ok && len(targets) >= maxClientTargets {
+		for name, idle := range targets {
+			if name != otherTarget && idle.refs == 0 {
+				delete(targets, name)
+				break
+			}
+		}
+		if len(targets) >= maxClientTargets {
+			target = otherTarget
+			t, ok = targets[target]
+		}
+	}
+	if !ok {
+		t = &targetStats{name: target, methods: make(map[string]*methodStats)}
+		targets[target] = t
+	}
+	t.refs++
+	return t
+}
+
+// retain 增加一个引用并返回应该使用的指标. t 没有引用的时候可能已经被删掉了,
+// 这时改用同名的新指标, 没有的话把 t 放回去
+func (t *targetStats) retain() *targetStats {
+	clientMetrics.mu.Lock()
+	defer clientMetrics.mu.Unlock()
+	if cur, ok := clientMetrics.targets[t.name]; ok {
+		t = cur
+	} else {
+		clientMetrics.targets[t.name] = t
+	}
+	t.refs++
+	return t
+}
+
+func (t *targetStats) release() {
+	clientMetrics.mu.Lock()
+	defer clientMetrics.mu.Unlock()
+	t.refs--
+}
+
+func (t *targetStats) stats(serviceMethod string) *methodStats {
+	st, ok := t.methods[serviceMethod]
+	if !ok {
+		st = &methodStats{codes: make(map[Code]uint64)}
+		t.methods[serviceMethod] = st
+	}
+	return st
+}
+
+func (t *targetStats) begin(serviceMethod string) {
+	t.mu.Lock()
+	t.stats(serviceMethod).inflight++
+	t.mu.Unlock()
+}
+
+func (t *targetStats) end(serviceMethod string, err error, d time.Duration) {
+	t.mu.Lock()
+	st := t.stats(serviceMethod)
+	st.inflight--
+	st.codes[CodeOf(err)]++
+	st.latency.observe(d.Seconds())
+	t.mu.Unlock()
+}
+
+// WriteClientMetrics writes the metrics of every client of this process
+// in the Prometheus text format.
+func WriteClientMetrics(w io.Writer) error {
+	clientMetrics.mu.Lock()
+	names := make([]string, 0, len(clientMetrics.targets))
+	for name := range clientMetrics.targets {
+		names = append(names, name)
+	}
+	targets := make([]*targetStats, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		targets[i] = clientMetrics.targets[name]
+	}
+	clientMetrics.mu.Unlock()
+
+	mw := &metricWriter{w: w}
+	gauges := []struct {
+		name, typ, help string
+		value           func(t *targetStats) float64
+	}{
+		{"tearpc_client_connections", "gauge", "Open connections.", func(t *targetStats) float64 { return float64(atomic.LoadInt64(&t.connections)) }},
+		{"tearpc_client_dial_failures_total", "counter", "Failed attempts to connect.", func(t *targetStats) float64 { return float64(atomic.LoadUint64(&t.dialFailures)) }},
+		{"tearpc_client_handshake_failures_total", "counter", "Connections that failed during the handshake.", func(t *targetStats) float64 { return float64(atomic.LoadUint64(&t.handshakeFailures)) }},
+		{"tearpc_client_sent_bytes_total", "counter", "Bytes written to servers.", func(t *targetStats) float64 { return float64(atomic.LoadUint64(&t.sentBytes)) }},
+		{"tearpc_client_received_bytes_total", "counter", "Bytes read from servers.", func(t *targetStats) float64 { return float64(atomic.LoadUint64(&t.receivedBytes)) }},
+	}
+	for _, g := range gauges {
+		mw.help(g.name, g.typ, g.help)
+		for i, t := range targets {
+			mw.sample(g.name, []string{"target", names[i]}, g.value(t))
+		}
+	}
+
+	var (
+		stats  []*methodStats
+		labels [][]string
+	)
+	for i, t := range targets {
+		t.mu.Lock()
+		methods := make([]string, 0, len(t.methods))
+		for m := range t.methods {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		for _, m := range methods {
+			stats = append(stats, t.methods[m].clone())
+			labels = append(labels, []string{"target", names[i], "method", m})
+		}
+		t.mu.Unlock()
+	}
+	mw.methods("tearpc_client", "calls", stats, labels)
+	return mw.err
+}
+
+// metricWriter 输出 Prometheus 文本格式, 记住第一个写错误
+type metricWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricWriter) printf(format string, a ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, a...)
+	}
+}
+
+func (mw *metricWriter) help(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels 是 key, value 交替的列表
+func (mw *metricWriter) sample(name string, labels []string, v float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		b.WriteByte('}')
+	}
+	mw.printf("%s %s\n", b.String(), strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mw *metricWriter) gauge(name, help string, labels []string, v float64) {
+	mw.help(name, "gauge", help)
+	mw.sample(name, labels, v)
+}
+
+func (mw *metricWriter) counter(name, help string, labels []string, v float64) {
+	mw.help(name, "counter", help)
+	mw.sample(name, labels, v)
+}
+
+// methods 输出按方法统计的指标, labels[i] 是 stats[i] 的标签
+func (mw *metricWriter) methods(prefix, what string, stats []*methodStats, labels [][]string) {
+	mw.help(prefix+"_in_flight", "gauge", "In-flight "+what+".")
+	for i, st := range stats {
+		mw.sample(prefix+"_in_flight", labels[i], float64(st.inflight))
+	}
+	mw.help(prefix+"_handled_total", "counter", "Completed "+what+" by status code.")
+	for i, st := range stats {
+		codes := make([]Code, 0, len(st.codes))
+		for c := range st.codes {
+			codes = append(codes, c)
+		}
+		sort.Slice(codes, func(a, b int) bool { return codes[a] < codes[b] })
+		for _, c := range codes {
+			mw.sample(prefix+"_handled_total", append(labels[i][:len(labels[i]):len(labels[i])], "code", c.String()), float64(st.codes[c]))
+		}
+	}
+	name := prefix + "_handling_seconds"
+	mw.help(name, "histogram", "Latency of "+what+".")
+	for i, st := range stats {
+		if st.latency.count == 0 {
+			continue
+		}
+		l := labels[i][:len(labels[i]):len(labels[i])]
+		var cum uint64
+		for j, le := range latencyBuckets {
+			cum += st.latency.counts[j]
+			mw.sample(name+"_bucket", append(l, "le", strconv.FormatFloat(le, 'g', -1, 64)), float64(cum))
+		}
+		mw.sample(name+"_bucket", append(l, "le", "+Inf"), float64(st.latency.count))
+		mw.sample(name+"_sum", l, st.latency.sum)
+		mw.sample(name+"_count", l, float64(st.latency.count))
+	}
+}
+
+type metricsHTTP struct {
+	*Server
+}
+
+// Runs at /debug/geerpc/metrics
+func (server metricsHTTP) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := server.WriteMetrics(w); err != nil {
+		return
+	}
+	_ = WriteClientMetrics(w)
+}
@@ -0,0 +1,121 @@
+package tearpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	var sl Sleeper
+	_ = s.Register(&foo)
+	_ = s.Register(&sl)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	addr := l.Addr().String()
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+
+	var reply int
+	for i := 0; i < 3; i++ {
+		_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: i}, &reply)
+	}
+	_ = client.Call(context.Background(), "Foo.Nope", Args{}, &reply)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_ = client.Call(ctx, "Sleeper.Nap", 100*time.Millisecond, &reply)
+
+	bad, _ := net.Dial("tcp", addr) // 握手失败
+	_, _ = bad.Write([]byte("not json\n"))
+	_ = bad.Close()
+	_ = client.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = closed.Close()
+	_, _ = Dial("tcp", closed.Addr().String()) // 连接失败
+
+	// 等服务端处理完握手失败的连接和 Nap 的超时
+	var out string
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		metricsHTTP{s}.ServeHTTP(rec, httptest.NewRequest("GET", defaultMetricsPath, nil))
+		out = rec.Body.String()
+		if strings.Contains(out, `tearpc_server_handshake_failures_total{reason="option"} 1`) &&
+			strings.Contains(out, `tearpc_server_connections 0`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, want := range []string{
+		`tearpc_server_connections 0`,
+		`tearpc_server_connections_total 2`,
+		`tearpc_server_handshake_failures_total{reason="option"} 1`,
+		`tearpc_server_handled_total{service="Foo",method="Sum",code="OK"} 3`,
+		`tearpc_server_handled_total{service="unknown",method="unknown",code="NotFound"} 1`,
+		`tearpc_server_in_flight{service="Foo",method="Sum"} 0`,
+		`tearpc_server_handling_seconds_bucket{service="Foo",method="Sum",le="+Inf"} 3`,
+		`tearpc_server_handling_seconds_count{service="Foo",method="Sum"} 3`,
+		`# TYPE tearpc_server_handling_seconds histogram`,
+		`tearpc_client_connections{target="` + addr + `"} 0`,
+		`tearpc_client_handled_total{target="` + addr + `",method="Foo.Sum",code="OK"} 3`,
+		`tearpc_client_handled_total{target="` + addr + `",method="Foo.Nope",code="NotFound"} 1`,
+		`tearpc_client_handled_total{target="` + addr + `",method="Sleeper.Nap",code="DeadlineExceeded"} 1`,
+		`tearpc_client_in_flight{target="` + addr + `",method="Sleeper.Nap"} 0`,
+		`tearpc_client_dial_failures_total{target="` + closed.Addr().String() + `"} 1`,
+	} {
+		_assert(strings.Contains(out, want), "missing %q in\n%s", want, out)
+	}
+	_assert(!strings.Contains(out, "tearpc_server_received_bytes_total 0") &&
+		!strings.Contains(out, `tearpc_client_sent_bytes_total{target="`+addr+`"} 0`), "expect bytes to be counted")
+}
+
+func TestMetrics_ZeroServer(t *testing.T) {
+	s := &Server{} // 没有通过 NewServer 创建
+	var foo Foo
+	_ = s.Register(&foo)
+	client, done := dialTestServer(s)
+	defer done()
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "call failed: %d %v", reply, err)
+
+	var out strings.Builder
+	_assert(s.WriteMetrics(&out) == nil, "write metrics failed")
+	want := `tearpc_server_handled_total{service="Foo",method="Sum",code="OK"} 1`
+	_assert(strings.Contains(out.String(), want), "missing %q in\n%s", want, out.String())
+}
+
+func TestClientTargetsBounded(t *testing.T) {
+	busy := acquireTarget("busy.test:1")
+	defer busy.release()
+	for i := 0; i < 2*maxClientTargets; i++ {
+		acquireTarget(fmt.Sprintf("idle.test:%d", i)).release()
+	}
+	clientMetrics.mu.Lock()
+	n, kept := len(clientMetrics.targets), clientMetrics.targets["busy.test:1"] == busy
+	clientMetrics.mu.Unlock()
+	_assert(n <= maxClientTargets, "expect at most %d targets, got %d", maxClientTargets, n)
+	_assert(kept, "a target in use must not be dropped")
+
+	// 打开的客户端一直引用自己的目标, 指标不会被删掉, 也不会换成新的
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(&foo)
+	client, done := dialTestServer(s)
+	defer done()
+	for i := 0; i < 2*maxClientTargets; i++ {
+		acquireTarget(fmt.Sprintf("idle.test:%d", i)).release()
+	}
+	var reply int
+	_assert(client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil, "call failed")
+	clientMetrics.mu.Lock()
+	live := clientMetrics.targets[client.addr] == client.target
+	clientMetrics.mu.Unlock()
+	_assert(live, "the target of an open client must stay registered")
+}
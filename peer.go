@@ -0,0 +1,72 @@
+package tearpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// Peer describes the remote side of a server connection. Handlers that take
+// a context.Context as first argument can read it with PeerFromContext.
+type Peer struct {
+	Addr net.Addr
+	// TLS is the state of the TLS connection, nil for plaintext connections.
+	TLS *tls.ConnectionState
+	// Identity is the authenticated identity of the client, taken from the
+	// verified client certificate when mutual TLS is used.
+	Identity string
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer of the connection the request came from.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+func withPeer(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// 取出 host 部分, 同一个客户端的不同连接共享一个限流的桶
+func (p *Peer) host() string {
+	if p == nil || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func newPeer(conn interface{}) *Peer {
+	p := &Peer{}
+	if c, ok := conn.(net.Conn); ok {
+		p.Addr = c.RemoteAddr()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		state := c.ConnectionState()
+		p.TLS = &state
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			p.Identity = CertIdentity(state.VerifiedChains[0][0])
+		}
+	}
+	return p
+}
+
+// CertIdentity returns the identity carried by a client certificate: its
+// subject common name, or else its first URI or DNS subject alternative name.
+func CertIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package tearpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+进程内的传输, 测试不需要监听真实的端口:
+
+	l, _ := tearpc.ListenPipe("")        // 名字为空时自动生成一个
+	go server.Accept(l)
+	client, _ := tearpc.Dial("pipe", l.Addr().String())  // 或者 XDial("pipe@" + name)
+
+每个连接是一对 net.Pipe, 同步且没有缓冲, 支持读写超时. 监听的名字登记在进程内的表里, Dial 按名字找到监听者
+*/
+
+// PipeNetwork is the network name of in-memory connections.
+const PipeNetwork = "pipe"
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return PipeNetwork }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn 是 net.Pipe 的一端, 换上有意义的地址
+type pipeConn struct {
+	net.Conn
+	local, remote pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// PipeListener is a net.Listener for in-memory connections, made with
+// ListenPipe and connected to with Dial("pipe", name).
+type PipeListener struct {
+	name   pipeAddr
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	connID uint64
+}
+
+var (
+	pipeMu        sync.Mutex
+	pipeListeners = make(map[string]*PipeListener)
+	pipeSeq       uint64
+)
+
+// ListenPipe listens for in-memory connections under name, which must not
+// be in use in this process. An empty name picks a unique one.
+func ListenPipe(name string) (*PipeListener, error) {
+	pipeMu.Lock()
+	defer pipeMu.Unlock()
+	if name == "" {
+		pipeSeq++
+		name = fmt.Sprintf("pipe-%d", pipeSeq)
+	}
+	if _, ok := pipeListeners[name]; ok {
+		return nil, fmt.Errorf("rpc pipe: listen %s: address already in use", name)
+	}
+	l := &PipeListener{name: pipeAddr(name), conns: make(chan net.Conn), done: make(chan struct{})}
+	pipeListeners[name] = l
+	return l, nil
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: PipeNetwork, Addr: l.name, Err: net.ErrClosed}
+	}
+}
+
+// Close stops the listener. Connections already accepted stay open.
+func (l *PipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		pipeMu.Lock()
+		defer pipeMu.Unlock()
+		if pipeListeners[string(l.name)] == l {
+			delete(pipeListeners, string(l.name))
+		}
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr { return l.name }
+
+// Dial opens a connection to l. timeout bounds the wait for Accept; 0
+// means no limit.
+func (l *PipeListener) Dial(timeout time.Duration) (net.Conn, error) {
+	client, server := net.Pipe()
+	// 客户端这一端用 名字#编号 区分, 服务端看到的对端地址就是它
+	id := pipeAddr(fmt.Sprintf("%s#%d", l.name, atomic.AddUint64(&l.connID, 1)))
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case l.conns <- &pipeConn{Conn: server, local: l.name, remote: id}:
+		return &pipeConn{Conn: client, local: id, remote: l.name}, nil
+	case <-l.done:
+		err = net.ErrClosed
+	case <-expired:
+		err = errPipeTimeout
+	}
+	_ = client.Close()
+	_ = server.Close()
+	return nil, &net.OpError{Op: "dial", Net: PipeNetwork, Addr: l.name, Err: err}
+}
+
+var errPipeTimeout = errors.New("i/o timeout")
+
+// DialPipe connects to the in-memory listener named name.
+func DialPipe(name string, timeout time.Duration) (net.Conn, error) {
+	pipeMu.Lock()
+	l := pipeListeners[name]
+	pipeMu.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: PipeNetwork, Addr: pipeAddr(name), Err: errors.New("connection refused")}
+	}
+	return l.Dial(timeout)
+}
+
+// dialNetwork 和 net.DialTimeout 一样, 另外支持进程内的 pipe
+func dialNetwork(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == PipeNetwork {
+		return DialPipe(address, timeout)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
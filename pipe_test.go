@@ -0,0 +1,53 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeListener(t *testing.T) {
+	l, err := ListenPipe("")
+	_assert(err == nil, "listen failed: %v", err)
+	_, err = ListenPipe(l.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), "in use"), "expect address in use, got %v", err)
+
+	// 没有人 Accept 时 Dial 会超时
+	_, err = DialPipe(l.Addr().String(), 10*time.Millisecond)
+	_assert(err != nil && strings.Contains(err.Error(), "timeout"), "expect a timeout, got %v", err)
+
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.RegisterFunc("Peer.Addr", func(ctx context.Context, args int, reply *string) error {
+		p, _ := PeerFromContext(ctx)
+		*reply = p.Addr.Network() + " " + p.Addr.String()
+		return nil
+	})
+	go server.Accept(l)
+	client, err := Dial(PipeNetwork, l.Addr().String())
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call failed: %d %v", sum, err)
+	var addr string
+	err = client.Call(context.Background(), "Peer.Addr", 0, &addr)
+	// 超时的那次 Dial 用掉了 #1
+	_assert(err == nil && addr == "pipe "+l.Addr().String()+"#2", "unexpected peer %q %v", addr, err)
+
+	// 关闭之后名字可以重新使用, 已经建立的连接不受影响
+	_ = l.Close()
+	_, err = l.Accept()
+	_assert(errors.Is(err, net.ErrClosed), "expect ErrClosed, got %v", err)
+	_, err = DialPipe(l.Addr().String(), 0)
+	_assert(err != nil, "expect dial to a closed listener to fail")
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 2, Num2: 2}, &sum)
+	_assert(err == nil && sum == 4, "call after close failed: %d %v", sum, err)
+	l2, err := ListenPipe(l.Addr().String())
+	_assert(err == nil, "name not released: %v", err)
+	_ = l2.Close()
+}
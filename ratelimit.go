@@ -0,0 +1,319 @@
+package tearpc
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+限流: 令牌桶算法
+每个桶以固定速率 Rate 往桶里放令牌, 桶最多存放 Burst 个令牌, 每次调用消耗一个令牌.
+桶里没有令牌的时候拒绝请求, 并告诉客户端多久之后再来(retry after).
+
+限流的维度(LimitKind)可以是: 全局, 客户端地址, 认证后的身份, 以及 "Service.Method"
+*/
+
+// LimitKind 限流的维度
+type LimitKind int
+
+const (
+	LimitGlobal     LimitKind = iota // 所有请求共用一个桶
+	LimitByAddr                      // 按客户端地址(host)分桶
+	LimitByIdentity                  // 按认证后的身份分桶
+	LimitByMethod                    // 按 "Service.Method" 分桶
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitGlobal:
+		return "global"
+	case LimitByAddr:
+		return "addr"
+	case LimitByIdentity:
+		return "identity"
+	case LimitByMethod:
+		return "method"
+	}
+	return fmt.Sprintf("LimitKind(%d)", int(k))
+}
+
+// Limit 描述一个令牌桶: 每秒产生 Rate 个令牌, 最多积攒 Burst 个.
+// Rate 为 0 表示完全禁止; Rate 大于 0 而 Burst 不大于 0 时, Burst 取 max(1, ceil(Rate))
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// 补上 Burst 的默认值, 否则桶里永远攒不到一个令牌, 所有请求都会被拒绝
+func (limit Limit) normalize() Limit {
+	if limit.Rate > 0 && limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return limit
+}
+
+// ErrRateLimited is matched (via errors.Is) by every *RateLimitError,
+// on both the server and the client side.
+var ErrRateLimited = errors.New("rpc: rate limit exceeded")
+
+// RateLimitError is returned for calls rejected by a RateLimiter.
+// RetryAfter is a hint of how long the caller should wait before retrying.
+type RateLimitError struct {
+	Kind       LimitKind
+	Key        string
+	RetryAfter time.Duration
+	status     *Status // 客户端从 header 中还原出来的 Status
+}
+
+func (e *RateLimitError) Error() string {
+	if e.status != nil {
+		return e.status.Error()
+	}
+	return fmt.Sprintf("rpc server: rate limit exceeded for %s %q, retry after %s", e.Kind, e.Key, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool { return target == ErrRateLimited }
+
+func (e *RateLimitError) Unwrap() error { return e.Status() }
+
+// Status converts the error to a ResourceExhausted status with a RetryInfo detail.
+func (e *RateLimitError) Status() *Status {
+	if e.status != nil {
+		return e.status
+	}
+	return NewStatus(ResourceExhausted, e.Error()).WithDetails(RetryInfo{RetryAfter: e.RetryAfter})
+}
+
+type tokenBucket struct {
+	key    string
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// 先按时间补充令牌, 再看能不能取一个, 不取走; 取不到时返回需要等待的时间
+func (b *tokenBucket) check(now time.Time) (bool, time.Duration) {
+	if b.limit.Rate <= 0 { // 速率为0表示完全禁止
+		return false, time.Second
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens += elapsed * b.limit.Rate
+	if burst := float64(b.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// 每个维度最多这么多个桶, 防止按地址或者身份限流时 map 无限增长.
+// 满了以后丢掉最久没有用过的桶, 它最可能已经补满, 重建的影响最小
+const maxBuckets = 4096
+
+// bucketSet 一个维度的令牌桶, 按最近使用的顺序排列
+type bucketSet struct {
+	m   map[string]*list.Element // Value 是 *tokenBucket
+	lru *list.List               // 最近用过的在前面
+}
+
+func newBucketSet() *bucketSet {
+	return &bucketSet{m: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *bucketSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.m)
+}
+
+func (s *bucketSet) get(key string) *tokenBucket {
+	if s == nil {
+		return nil
+	}
+	if e := s.m[key]; e != nil {
+		return e.Value.(*tokenBucket)
+	}
+	return nil
+}
+
+func (s *bucketSet) remove(key string) {
+	if e := s.m[key]; e != nil {
+		s.lru.Remove(e)
+		delete(s.m, key)
+	}
+}
+
+// RateLimiter is a set of token buckets that can be attached to a Server.
+// Limits are configured per LimitKind, either as a default applied to every
+// key of that kind or for one specific key, and may be changed at any time.
+type RateLimiter struct {
+	mu        sync.Mutex
+	defaults  map[LimitKind]Limit
+	overrides map[LimitKind]map[string]Limit
+	buckets   map[LimitKind]*bucketSet
+	now       func() time.Time // 方便测试替换
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		defaults:  make(map[LimitKind]Limit),
+		overrides: make(map[LimitKind]map[string]Limit),
+		buckets:   make(map[LimitKind]*bucketSet),
+		now:       time.Now,
+	}
+}
+
+// SetLimit sets the default limit for every key of the given kind.
+// For LimitGlobal the key is ignored. A zero Burst with a positive Rate
+// defaults to max(1, ceil(Rate)).
+func (l *RateLimiter) SetLimit(kind LimitKind, limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaults[kind] = limit.normalize()
+	l.resetBuckets(kind)
+}
+
+// SetKeyLimit sets the limit for one key, e.g. a single "Service.Method",
+// overriding the default of its kind. Burst defaults as in SetLimit.
+func (l *RateLimiter) SetKeyLimit(kind LimitKind, key string, limit Limit) {
+	limit = limit.normalize()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.overrides[kind] == nil {
+		l.overrides[kind] = make(map[string]Limit)
+	}
+	l.overrides[kind][key] = limit
+	if b := l.buckets[kind].get(key); b != nil {
+		b.limit = limit
+	}
+}
+
+// RemoveLimit drops the default limit of a kind; per-key limits are kept.
+func (l *RateLimiter) RemoveLimit(kind LimitKind) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.defaults, kind)
+	l.resetBuckets(kind)
+}
+
+// RemoveKeyLimit drops the limit of a single key.
+func (l *RateLimiter) RemoveKeyLimit(kind LimitKind, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides[kind], key)
+	if b := l.buckets[kind].get(key); b != nil {
+		if limit, ok := l.defaults[kind]; ok {
+			b.limit = limit
+		} else {
+			l.buckets[kind].remove(key)
+		}
+	}
+}
+
+// 默认限流变化的时候, 更新没有单独配置的桶
+func (l *RateLimiter) resetBuckets(kind LimitKind) {
+	limit, ok := l.defaults[kind]
+	set := l.buckets[kind]
+	if set == nil {
+		return
+	}
+	for key, e := range set.m {
+		if _, override := l.overrides[kind][key]; override {
+			continue
+		}
+		if ok {
+			e.Value.(*tokenBucket).limit = limit
+		} else {
+			set.remove(key)
+		}
+	}
+}
+
+func (l *RateLimiter) limitFor(kind LimitKind, key string) (Limit, bool) {
+	if limit, ok := l.overrides[kind][key]; ok {
+		return limit, true
+	}
+	limit, ok := l.defaults[kind]
+	return limit, ok
+}
+
+func (l *RateLimiter) bucket(kind LimitKind, key string, now time.Time) *tokenBucket {
+	limit, ok := l.limitFor(kind, key)
+	if !ok {
+		return nil
+	}
+	set := l.buckets[kind]
+	if set == nil {
+		set = newBucketSet()
+		l.buckets[kind] = set
+	}
+	if e := set.m[key]; e != nil {
+		set.lru.MoveToFront(e)
+		return e.Value.(*tokenBucket)
+	}
+	if set.len() >= maxBuckets {
+		set.remove(set.lru.Back().Value.(*tokenBucket).key)
+	}
+	b := &tokenBucket{key: key, limit: limit, tokens: float64(limit.Burst), last: now}
+	set.m[key] = set.lru.PushFront(b)
+	return b
+}
+
+// limitInfo 一次调用中用来选择令牌桶的信息
+type limitInfo struct {
+	Addr         string
+	Identity     string
+	ServerMethod string
+}
+
+func (info limitInfo) key(kind LimitKind) (string, bool) {
+	switch kind {
+	case LimitGlobal:
+		return "", true
+	case LimitByAddr:
+		return info.Addr, info.Addr != ""
+	case LimitByIdentity:
+		return info.Identity, info.Identity != ""
+	case LimitByMethod:
+		return info.ServerMethod, info.ServerMethod != ""
+	}
+	return "", false
+}
+
+var limitKinds = []LimitKind{LimitGlobal, LimitByAddr, LimitByIdentity, LimitByMethod}
+
+// allow 先检查每个维度的令牌桶, 任意一个没有令牌就拒绝; 都有令牌时才从每个桶里各取一个.
+// 被拒绝的请求不消耗任何令牌, 一个客户端超出自己的限额不会耗尽全局的令牌
+func (l *RateLimiter) allow(info limitInfo) *RateLimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var taken [4]*tokenBucket // 每个维度最多一个桶
+	buckets := taken[:0]
+	for _, kind := range limitKinds {
+		key, ok := info.key(kind)
+		if !ok {
+			continue
+		}
+		b := l.bucket(kind, key, now)
+		if b == nil {
+			continue
+		}
+		if ok, wait := b.check(now); !ok {
+			return &RateLimitError{Kind: kind, Key: key, RetryAfter: wait}
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
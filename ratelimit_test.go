@@ -0,0 +1,92 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+	l.SetLimit(LimitByAddr, Limit{Rate: 1, Burst: 2})
+	info := limitInfo{Addr: "10.0.0.1", ServerMethod: "Foo.Sum"}
+
+	_assert(l.allow(info) == nil && l.allow(info) == nil, "burst of 2 should be allowed")
+	err := l.allow(info)
+	_assert(err != nil && err.Kind == LimitByAddr && err.RetryAfter == time.Second, "expect a rate limit error, got %v", err)
+	_assert(l.allow(limitInfo{Addr: "10.0.0.2"}) == nil, "other addresses have their own bucket")
+
+	now = now.Add(time.Second)
+	_assert(l.allow(info) == nil, "a token should be refilled after 1s")
+
+	// 运行时调整
+	l.SetKeyLimit(LimitByMethod, "Foo.Sum", Limit{Rate: 0})
+	err = l.allow(limitInfo{ServerMethod: "Foo.Sum"})
+	_assert(err != nil && err.Kind == LimitByMethod, "Foo.Sum should be blocked")
+	l.RemoveKeyLimit(LimitByMethod, "Foo.Sum")
+	_assert(l.allow(limitInfo{ServerMethod: "Foo.Sum"}) == nil, "Foo.Sum should be allowed again")
+}
+
+func TestRateLimiter_BucketsBounded(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+	l.SetLimit(LimitByIdentity, Limit{Rate: 0.001, Burst: 1})
+	// 每个身份都用光了令牌, 没有补满的桶可以清理
+	for i := 0; i < 2*maxBuckets; i++ {
+		_assert(l.allow(limitInfo{Identity: fmt.Sprint("user-", i)}) == nil, "first call of a new identity should be allowed")
+	}
+	_assert(l.buckets[LimitByIdentity].len() <= maxBuckets, "expect at most %d buckets, got %d", maxBuckets, l.buckets[LimitByIdentity].len())
+}
+
+func TestRateLimiter_RejectedCallsKeepTokens(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+	l.SetLimit(LimitGlobal, Limit{Rate: 1, Burst: 2})
+	l.SetLimit(LimitByAddr, Limit{Rate: 1, Burst: 1})
+	abuser := limitInfo{Addr: "10.0.0.1"}
+	_assert(l.allow(abuser) == nil, "first call should be allowed")
+	for i := 0; i < 10; i++ {
+		err := l.allow(abuser)
+		_assert(err != nil && err.Kind == LimitByAddr, "expect the addr limit, got %v", err)
+	}
+	// 被拒绝的调用没有消耗全局的令牌
+	_assert(l.allow(limitInfo{Addr: "10.0.0.2"}) == nil, "other clients should still get the global token")
+}
+
+func TestRateLimiter_DefaultBurst(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+	l.SetLimit(LimitGlobal, Limit{Rate: 2.5})
+	for i := 0; i < 3; i++ {
+		_assert(l.allow(limitInfo{}) == nil, "burst should default to ceil(rate), call %d was rejected", i)
+	}
+	_assert(l.allow(limitInfo{}) != nil, "the fourth call should be rejected")
+	l.SetKeyLimit(LimitByMethod, "Foo.Sum", Limit{Rate: 0.1})
+	now = now.Add(time.Second)
+	_assert(l.allow(limitInfo{ServerMethod: "Foo.Sum"}) == nil, "burst should be at least 1")
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(&foo)
+	s.Limiter = NewRateLimiter()
+	s.Limiter.SetKeyLimit(LimitByMethod, "Foo.Sum", Limit{Rate: 0.5, Burst: 1})
+	client, done := dialTestServer(s)
+	defer done()
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "first call should pass")
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	var rle *RateLimitError
+	_assert(errors.Is(err, ErrRateLimited) && errors.Is(err, ResourceExhausted) && errors.As(err, &rle) && rle.RetryAfter > 0,
+		"expect a rate limit error with retry-after hint, got %v", err)
+}
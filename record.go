@@ -0,0 +1,395 @@
+package tearpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+录制和回放, 用于回归测试:
+1、Server.Recorder 不为空时, 服务端读到的每个请求(header + body)和写出的每个响应都会以一行 JSON 写进录制文件.
+   录制发生在 codec 这一层, readRequest 解码出来的参数和 sendResponse 发送的返回值原样记录, 心跳不记录.
+   header 里的凭证(authorization 和签名)不会写进文件, 参数和返回值里 Redact 列出的字段脱敏之后再写,
+   规则和 AccessLog.Redact 一样. 脱敏过的字段回放时发送的是 "[REDACTED]", 比较返回值时应该放进 Replayer.Ignore
+2、Replayer 读取录制文件, 按请求的顺序用 DynamicClient 重新发起调用, 和录制的响应比较.
+   同一个连接里 Seq 是唯一的, 用 (Conn, Seq) 把请求和响应配对, 没有响应的请求会被跳过
+*/
+
+type RecordKind string
+
+const (
+	RecordRequest  RecordKind = "request"
+	RecordResponse RecordKind = "response"
+)
+
+// RecordEntry is one line of a capture file.
+type RecordEntry struct {
+	Kind   RecordKind
+	Time   time.Time
+	Conn   uint64 // 连接的编号, 同一个连接里 Seq 唯一
+	Header codec.Header
+	Body   json.RawMessage `json:",omitempty"`
+}
+
+// Recorder writes the traffic of a Server to a capture file, one
+// RecordEntry per line.
+type Recorder struct {
+	// Redact 列出需要脱敏的参数和返回值字段, 要在开始录制之前设置
+	Redact []string
+
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	redact redactor
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// NewFileRecorder appends to the file at path, creating it readable only
+// by the owner if needed. Close the recorder to close the file.
+func NewFileRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// 凭证不写进录制文件
+var unrecordedMeta = []string{MetaAuthorization, MetaSignature}
+
+func (r *Recorder) record(kind RecordKind, conn uint64, h *codec.Header, body interface{}) {
+	entry := RecordEntry{Kind: kind, Time: time.Now(), Conn: conn, Header: *h}
+	if len(h.Meta) > 0 {
+		entry.Header.Meta = make(map[string]string, len(h.Meta))
+		for k, v := range h.Meta {
+			entry.Header.Meta[k] = v
+		}
+		for _, k := range unrecordedMeta {
+			delete(entry.Header.Meta, k)
+		}
+	}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err == nil && len(r.Redact) > 0 {
+			var v interface{}
+			if v, err = r.redact.apply(r.Redact, body); err == nil {
+				data, err = json.Marshal(v)
+			}
+		}
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprintf("rpc recorder: encode body: %v", err))
+		}
+		entry.Body = data
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = r.w.Write(line)
+}
+
+// wrap 返回一个会把读写内容记录下来的 codec, r 为空时原样返回
+func (r *Recorder) wrap(cc codec.Codec, conn uint64) codec.Codec {
+	if r == nil {
+		return cc
+	}
+	rc := &recordingCodec{Codec: cc, rec: r, conn: conn}
+	if d, ok := cc.(deferredWriter); ok { // 下层会推迟发送响应, 要把写出的大小传上去
+		return &deferredRecordingCodec{recordingCodec: rc, d: d}
+	}
+	return rc
+}
+
+// recordingCodec 在 codec 这一层旁路出请求和响应.
+// ReadHeader 和 ReadBody 只在 serveCodec 的 goroutine 里按顺序调用, Write 有 sending 锁保护
+type recordingCodec struct {
+	codec.Codec
+	rec  *Recorder
+	conn uint64
+	head codec.Header // 最近读到的 header, 等 body 读完一起记录
+}
+
+func (c *recordingCodec) ReadHeader(h *codec.Header) error {
+	err := c.Codec.ReadHeader(h)
+	if err == nil {
+		c.head = *h
+	}
+	return err
+}
+
+func (c *recordingCodec) ReadBody(body interface{}) error {
+	err := c.Codec.ReadBody(body)
+	if !isPing(&c.head) {
+		if err != nil {
+			body = nil
+		}
+		c.rec.record(RecordRequest, c.conn, &c.head, body)
+	}
+	return err
+}
+
+func (c *recordingCodec) Write(h *codec.Header, body interface{}) error {
+	if !isPong(h) {
+		c.rec.record(RecordResponse, c.conn, h, body)
+	}
+	return c.Codec.Write(h, body)
+}
+
+type deferredRecordingCodec struct {
+	*recordingCodec
+	d deferredWriter
+}
+
+func (c *deferredRecordingCodec) WriteDeferred(h *codec.Header, body interface{}, sent func(size int64)) error {
+	if !isPong(h) {
+		c.rec.record(RecordResponse, c.conn, h, body)
+	}
+	return c.d.WriteDeferred(h, body, sent)
+}
+
+// ReadRecords reads a capture file written by a Recorder.
+func ReadRecords(r io.Reader) ([]RecordEntry, error) {
+	var entries []RecordEntry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20) // 一行是一个完整的请求或响应, 可能很长
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var e RecordEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("rpc replay: line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// ReplayResult compares the recorded response of a call with the response
+// it got when replayed.
+type ReplayResult struct {
+	ServerMethod string
+	Seq          uint64 // 录制时的 seq
+	WantCode     Code
+	GotCode      Code
+	Want         json.RawMessage `json:",omitempty"`
+	Got          json.RawMessage `json:",omitempty"`
+	GotError     string          `json:",omitempty"`
+	// Diff 列出不一致的地方, 为空表示和录制的一致
+	Diff []string `json:",omitempty"`
+}
+
+func (r *ReplayResult) Match() bool { return len(r.Diff) == 0 }
+
+// Replayer re-issues recorded calls and diffs the responses.
+type Replayer struct {
+	client *DynamicClient
+	// Ignore 列出比较返回值时忽略的字段, 格式和 AccessLog.Redact 一样
+	Ignore []string
+}
+
+func NewReplayer(client *Client) *Replayer {
+	return &Replayer{client: NewDynamicClient(client)}
+}
+
+type recordKey struct {
+	conn uint64
+	seq  uint64
+}
+
+// Replay re-issues every call of the capture read from r, in the order
+// the requests were recorded, one at a time.
+func (rp *Replayer) Replay(ctx context.Context, r io.Reader) ([]ReplayResult, error) {
+	entries, err := ReadRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	var requests []*RecordEntry
+	responses := make(map[recordKey]*RecordEntry)
+	for i := range entries {
+		e := &entries[i]
+		key := recordKey{e.Conn, e.Header.Seq}
+		switch e.Kind {
+		case RecordRequest:
+			requests = append(requests, e)
+		case RecordResponse:
+			responses[key] = e
+		default:
+			return nil, fmt.Errorf("rpc replay: unknown record kind %q", e.Kind)
+		}
+	}
+
+	ignore := make(map[string]bool, len(rp.Ignore))
+	for _, name := range rp.Ignore {
+		ignore[strings.ToLower(name)] = true
+	}
+	var results []ReplayResult
+	for _, req := range requests {
+		resp := responses[recordKey{req.Conn, req.Header.Seq}]
+		if resp == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		results = append(results, rp.replay(ctx, req, resp, ignore))
+	}
+	return results, nil
+}
+
+func (rp *Replayer) replay(ctx context.Context, req, resp *RecordEntry, ignore map[string]bool) ReplayResult {
+	res := ReplayResult{
+		ServerMethod: req.Header.ServerMethod,
+		Seq:          req.Header.Seq,
+		WantCode:     Code(resp.Header.Code),
+	}
+	if res.WantCode == OK {
+		res.Want = resp.Body
+	}
+	if len(req.Header.Meta) > 0 {
+		ctx = WithMetadata(ctx, req.Header.Meta)
+	}
+	args := req.Body
+	if len(args) == 0 {
+		args = json.RawMessage("null")
+	}
+	got, err := rp.client.CallJSON(ctx, req.Header.ServerMethod, args)
+	res.GotCode = CodeOf(err)
+	if err != nil {
+		res.GotError = err.Error()
+	} else {
+		res.Got = got
+	}
+
+	if res.WantCode != res.GotCode {
+		res.Diff = append(res.Diff, fmt.Sprintf("code: want %s, got %s", res.WantCode.String(), res.GotCode.String()))
+		return res
+	}
+	if res.WantCode != OK {
+		return res
+	}
+	want, err1 := decodeGeneric(res.Want)
+	have, err2 := decodeGeneric(res.Got)
+	if err1 != nil || err2 != nil {
+		if !bytes.Equal(bytes.TrimSpace(res.Want), bytes.TrimSpace(res.Got)) {
+			res.Diff = append(res.Diff, fmt.Sprintf("reply: want %s, got %s", res.Want, res.Got))
+		}
+		return res
+	}
+	dropFields(want, "", ignore)
+	dropFields(have, "", ignore)
+	diffValue("reply", want, have, &res.Diff)
+	return res
+}
+
+func decodeGeneric(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// dropFields 删除 names 里列出的字段, 匹配规则和 redactValue 一样
+func dropFields(v interface{}, path string, names map[string]bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if names[strings.ToLower(k)] || names[strings.ToLower(p)] {
+				delete(x, k)
+				continue
+			}
+			dropFields(e, p, names)
+		}
+	case []interface{}:
+		for _, e := range x {
+			dropFields(e, path, names)
+		}
+	}
+}
+
+// diffValue 比较两个 json 解码出来的值, 把不一致的路径追加到 diff
+func diffValue(path string, want, got interface{}, diff *[]string) {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool, len(w)+len(g))
+		for k := range w {
+			keys[k] = true
+		}
+		for k := range g {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			wv, inWant := w[k]
+			gv, inGot := g[k]
+			switch {
+			case !inWant:
+				*diff = append(*diff, fmt.Sprintf("%s.%s: unexpected %s", path, k, jsonString(gv)))
+			case !inGot:
+				*diff = append(*diff, fmt.Sprintf("%s.%s: missing, want %s", path, k, jsonString(wv)))
+			default:
+				diffValue(path+"."+k, wv, gv, diff)
+			}
+		}
+		return
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			break
+		}
+		for i := range w {
+			diffValue(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], diff)
+		}
+		return
+	}
+	if !reflect.DeepEqual(want, got) {
+		*diff = append(*diff, fmt.Sprintf("%s: want %s, got %s", path, jsonString(want), jsonString(got)))
+	}
+}
+
+func jsonString(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
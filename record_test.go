@@ -0,0 +1,114 @@
+package tearpc
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"tearpc/codec"
+	"testing"
+)
+
+// bytes 返回目前写入的全部内容
+func (b *syncBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestRecordReplay(t *testing.T) {
+	var capture syncBuffer
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.Register(Account{})
+	server.Recorder = NewRecorder(&capture)
+	client, cleanup := dialTestServer(server)
+	defer cleanup()
+	jsonClient, cleanup2 := dialTestServer(server, &Option{MagicNumber: DefaultMagicNumber, CodecType: codec.JsonType})
+	defer cleanup2()
+
+	ctx := WithMetadata(context.Background(), map[string]string{MetaAuthorization: "Bearer t0k3n", "tenant": "acme"})
+	var sum int
+	_assert(client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum) == nil && sum == 3, "call failed: %d", sum)
+	var reply string
+	_assert(client.Call(ctx, "Account.Login", LoginArgs{User: "bob", Password: "secret"}, &reply) == nil, "login failed")
+	err := client.Call(ctx, "Account.Login", LoginArgs{User: "bob"}, &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+	_assert(jsonClient.Call(ctx, "Foo.Sum", Args{Num1: 3, Num2: 4}, &sum) == nil && sum == 7, "call failed: %d", sum)
+
+	data := capture.bytes()
+	entries, err := ReadRecords(bytes.NewReader(data))
+	_assert(err == nil && len(entries) == 8, "expect 8 entries, got %d %v", len(entries), err)
+	for _, e := range entries {
+		if e.Kind == RecordRequest {
+			_assert(e.Header.Meta["tenant"] == "acme", "metadata not recorded: %+v", e.Header)
+		}
+	}
+	_assert(!strings.Contains(string(data), "t0k3n"), "credentials must not be recorded:\n%s", data)
+
+	// 对同一个服务回放, 结果应该完全一致
+	replayClient, cleanup3 := dialTestServer(server)
+	defer cleanup3()
+	results, err := NewReplayer(replayClient).Replay(context.Background(), bytes.NewReader(data))
+	_assert(err == nil && len(results) == 4, "replay failed: %+v %v", results, err)
+	for _, r := range results {
+		_assert(r.Match(), "unexpected diff %+v", r)
+	}
+	_assert(results[2].WantCode == Unauthenticated && results[2].GotCode == Unauthenticated, "unexpected result %+v", results[2])
+
+	// 对行为变了的服务回放
+	changed := NewServer()
+	_ = changed.RegisterFunc("Foo.Sum", func(args Args, reply *int) error {
+		*reply = args.Num1 * args.Num2
+		return nil
+	})
+	changedClient, cleanup4 := dialTestServer(changed)
+	defer cleanup4()
+	results, err = NewReplayer(changedClient).Replay(context.Background(), bytes.NewReader(data))
+	_assert(err == nil && len(results) == 4, "replay failed: %+v %v", results, err)
+	_assert(!results[0].Match() && results[0].Diff[0] == "reply: want 3, got 2", "unexpected result %+v", results[0])
+	_assert(!results[1].Match() && results[1].GotCode == NotFound &&
+		results[1].Diff[0] == "code: want OK, got NotFound", "unexpected result %+v", results[1])
+	_assert(results[3].Diff[0] == "reply: want 7, got 12", "unexpected result %+v", results[3])
+}
+
+func TestDiffValue(t *testing.T) {
+	want, _ := decodeGeneric([]byte(`{"A":1,"B":{"C":[1,2]},"D":"x"}`))
+	got, _ := decodeGeneric([]byte(`{"A":1,"B":{"C":[1,3]},"E":true}`))
+	var diff []string
+	diffValue("reply", want, got, &diff)
+	expect := []string{`reply.B.C[1]: want 2, got 3`, `reply.D: missing, want "x"`, `reply.E: unexpected true`}
+	_assert(strings.Join(diff, "\n") == strings.Join(expect, "\n"), "unexpected diff %q", diff)
+
+	ignore := map[string]bool{"b.c": true, "d": true, "e": true}
+	dropFields(want, "", ignore)
+	dropFields(got, "", ignore)
+	diff = nil
+	diffValue("reply", want, got, &diff)
+	_assert(len(diff) == 0, "expect ignored fields to be skipped, got %q", diff)
+}
+
+func TestRecorder_Redact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	rec, err := NewFileRecorder(path)
+	_assert(err == nil, "create recorder failed: %v", err)
+	rec.Redact = []string{"Password"}
+	server := NewServer()
+	_ = server.Register(Account{})
+	server.Recorder = rec
+	client, cleanup := dialTestServer(server)
+	defer cleanup()
+
+	var reply string
+	_assert(client.Call(context.Background(), "Account.Login", LoginArgs{User: "bob", Password: "secret"}, &reply) == nil, "login failed")
+	_ = rec.Close()
+
+	info, err := os.Stat(path)
+	_assert(err == nil && info.Mode().Perm() == 0600, "capture file must be private, got %v %v", info.Mode(), err)
+	data, err := os.ReadFile(path)
+	_assert(err == nil, "read capture failed: %v", err)
+	_assert(!strings.Contains(string(data), "secret") && strings.Contains(string(data), redactedValue) && strings.Contains(string(data), "bob"),
+		"password must be redacted:\n%s", data)
+}
@@ -0,0 +1,182 @@
+package tearpc
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+内置的反射服务, NewServer 的时候自动注册, 客户端可以通过 tearpc 本身查询服务端提供了哪些服务:
+
+	var services []tearpc.ServiceInfo
+	client.Call(ctx, "tearpc.Reflection.List", 0, &services)
+
+	var m tearpc.MethodInfo
+	client.Call(ctx, "tearpc.Reflection.Method", "Foo.Sum", &m)
+
+	var timeouts map[string]time.Duration // 声明了默认调用超时的方法, 客户端连接时自动加载
+	client.Call(ctx, "tearpc.Reflection.CallTimeouts", 0, &timeouts)
+
+参数和返回值的类型用 TypeDesc 描述, 工具可以据此动态构造请求.
+不想暴露的话可以 server.Unregister(tearpc.ReflectionService)
+*/
+
+// ReflectionService is the name of the built-in introspection service.
+const ReflectionService = "tearpc.Reflection"
+
+// TypeDesc is a machine readable description of a Go type.
+type TypeDesc struct {
+	Kind   string // reflect.Kind 的名字, 比如 "int", "struct", "ptr", "slice", "map"
+	Name   string // 具名类型的名字(带包名), 比如 "main.Args"; 匿名类型为空
+	Elem   *TypeDesc
+	Key    *TypeDesc // map 的 key
+	Len    int       // 数组的长度
+	Fields []FieldDesc
+	// Ref 为 true 表示这是一个递归引用, 字段已经在外层的同名类型中描述过了
+	Ref bool `json:",omitempty"`
+}
+
+// FieldDesc describes an exported struct field.
+type FieldDesc struct {
+	Name      string
+	Type      *TypeDesc
+	Tag       string `json:",omitempty"`
+	Anonymous bool   `json:",omitempty"` // 嵌入的字段
+}
+
+// MethodInfo describes one method of a service.
+type MethodInfo struct {
+	Name        string
+	ArgType     *TypeDesc
+	ReplyType   *TypeDesc
+	WithContext bool
+	Timeout     time.Duration
+	CallTimeout time.Duration
+}
+
+// ServiceInfo describes a registered service.
+type ServiceInfo struct {
+	Name    string
+	Funcs   bool
+	Methods []MethodInfo
+}
+
+// DescribeType returns the description of t.
+func DescribeType(t reflect.Type) *TypeDesc {
+	return describeType(t, map[reflect.Type]bool{})
+}
+
+// path 记录当前正在描述的结构体, 遇到递归类型时只输出引用
+func describeType(t reflect.Type, path map[reflect.Type]bool) *TypeDesc {
+	d := &TypeDesc{Kind: t.Kind().String()}
+	if t.Name() != "" {
+		d.Name = t.String()
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		d.Elem = describeType(t.Elem(), path)
+	case reflect.Array:
+		d.Len = t.Len()
+		d.Elem = describeType(t.Elem(), path)
+	case reflect.Map:
+		d.Key = describeType(t.Key(), path)
+		d.Elem = describeType(t.Elem(), path)
+	case reflect.Struct:
+		if path[t] {
+			d.Ref = true
+			return d
+		}
+		path[t] = true
+		defer delete(path, t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() { // gob 和 json 都只编码导出的字段
+				continue
+			}
+			d.Fields = append(d.Fields, FieldDesc{Name: f.Name, Type: describeType(f.Type, path), Tag: string(f.Tag), Anonymous: f.Anonymous})
+		}
+	}
+	return d
+}
+
+func describeMethod(name string, m *methodType) MethodInfo {
+	return MethodInfo{
+		Name:        name,
+		ArgType:     DescribeType(m.ArgType),
+		ReplyType:   DescribeType(m.ReplyType),
+		WithContext: m.withCtx,
+		Timeout:     m.Timeout,
+		CallTimeout: m.CallTimeout,
+	}
+}
+
+func describeService(svc *service) ServiceInfo {
+	info := ServiceInfo{Name: svc.name, Funcs: svc.funcs}
+	methods := svc.methods()
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info.Methods = append(info.Methods, describeMethod(name, methods[name]))
+	}
+	return info
+}
+
+type reflectionService struct {
+	server *Server
+}
+
+// List returns every registered service, sorted by name.
+func (r *reflectionService) List(_ int, reply *[]ServiceInfo) error {
+	var services []ServiceInfo
+	r.server.serviceMap.Range(func(_, svci interface{}) bool {
+		services = append(services, describeService(svci.(*service)))
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	*reply = services
+	return nil
+}
+
+// Service describes the service called name.
+func (r *reflectionService) Service(name string, reply *ServiceInfo) error {
+	svci, ok := r.server.serviceMap.Load(name)
+	if !ok {
+		return Errorf(NotFound, "rpc service: can't find service %s", name)
+	}
+	*reply = describeService(svci.(*service))
+	return nil
+}
+
+// Method describes serviceMethod ("Service.Method").
+func (r *reflectionService) Method(serviceMethod string, reply *MethodInfo) error {
+	_, mtype, err := r.server.findServer(serviceMethod)
+	if err != nil {
+		return err
+	}
+	*reply = describeMethod(serviceMethod[strings.LastIndex(serviceMethod, ".")+1:], mtype)
+	return nil
+}
+
+// CallTimeouts returns the default client-side timeout of every method
+// that declares one, keyed by "Service.Method". Clients with
+// Option.LoadCallTimeouts load it when they connect, so the defaults apply
+// from the first call.
+func (r *reflectionService) CallTimeouts(_ int, reply *map[string]time.Duration) error {
+	timeouts := make(map[string]time.Duration)
+	r.server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		for name, m := range svc.methods() {
+			if m.CallTimeout > 0 {
+				timeouts[svc.name+"."+name] = m.CallTimeout
+			}
+		}
+		return true
+	})
+	*reply = timeouts
+	return nil
+}
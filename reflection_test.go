@@ -0,0 +1,54 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type Node struct {
+	Value    int
+	Children []*Node
+	Meta     map[string]string
+	secret   int
+}
+
+type Tree int
+
+func (t Tree) Sum(root Node, reply *int) error { return nil }
+
+func TestDescribeType(t *testing.T) {
+	d := DescribeType(reflect.TypeOf(Node{}))
+	_assert(d.Kind == "struct" && d.Name == "tearpc.Node" && len(d.Fields) == 3, "wrong struct desc: %+v", d)
+	children := d.Fields[1].Type
+	_assert(children.Kind == "slice" && children.Elem.Kind == "ptr" && children.Elem.Elem.Ref,
+		"recursive types should be described by reference: %+v", children.Elem.Elem)
+	meta := d.Fields[2].Type
+	_assert(meta.Kind == "map" && meta.Key.Kind == "string" && meta.Elem.Kind == "string", "wrong map desc: %+v", meta)
+}
+
+func TestReflectionService(t *testing.T) {
+	s := NewServer()
+	var tree Tree
+	var foo Foo
+	_ = s.Register(&tree)
+	_ = s.Register(&foo)
+	client, done := dialTestServer(s)
+	defer done()
+
+	var services []ServiceInfo
+	err := client.Call(context.Background(), ReflectionService+".List", 0, &services)
+	_assert(err == nil && len(services) == 3, "expect 3 services, got %v, %v", services, err)
+	_assert(services[0].Name == "Foo" && services[1].Name == "Tree" && services[2].Name == ReflectionService,
+		"services should be sorted: %v", services)
+
+	var m MethodInfo
+	err = client.Call(context.Background(), ReflectionService+".Method", "Tree.Sum", &m)
+	_assert(err == nil && m.Name == "Sum" && m.ArgType.Name == "tearpc.Node" && m.ReplyType.Elem.Kind == "int",
+		"wrong method info: %+v, %v", m, err)
+
+	var info ServiceInfo
+	err = client.Call(context.Background(), ReflectionService+".Service", "Nope", &info)
+	_assert(errors.Is(err, NotFound), "expect NotFound, got %v", err)
+}
@@ -1,16 +1,18 @@
 package tearpc
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"tearpc/codec" // 以最后一个/后面的内容作为imported 的name
 	"time"
 )
@@ -52,6 +54,24 @@ type Option struct {
 	CodecType      codec.Type
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	// TLSConfig 不为空时, 客户端使用 TLS 连接服务端. 只在本地使用, 不会发送给服务端
+	TLSConfig *tls.Config `json:"-"`
+	// Auth 握手时发送给服务端的凭证, 由 Credentials 生成
+	Auth        map[string]string `json:",omitempty"`
+	Credentials Credentials       `json:"-"`
+	// HeartbeatInterval 大于0时, 客户端按这个间隔发送心跳;
+	// 超过 HeartbeatTimeout(默认3个间隔)没有收到服务端的任何数据, 写也没有任何进展, 连接就会被关闭.
+	// 写请求时对端一直在读就不会超时; 但是服务端整个卡住(既不读也不回 pong)时和断开没有区别, 连接同样会被关闭
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// SpanExporter 不为空时, 客户端的每次调用都会记录一个 span
+	SpanExporter SpanExporter `json:"-"`
+	// Logger 为空时不输出日志
+	Logger *slog.Logger `json:"-"`
+	// LoadCallTimeouts 为 true 时, 客户端连接时通过反射服务加载服务端声明的默认调用超时,
+	// 每个方法从第一次调用起就使用默认超时; 否则要等收到这个方法的第一个响应才知道.
+	// 加载最多等 ConnectTimeout(没有设置时是5秒), 超时后忽略, NewClient 照常返回
+	LoadCallTimeouts bool `json:"-"`
 }
 
 // 提供的默认选项
@@ -67,15 +87,54 @@ type request struct {
 	Argv, ReplyArgv reflect.Value // 这里是reflect.Value ,思考下为什么不能是Type //因为这里保存的是具体的值,后续要操作的,不是要使用类型
 	mtype           *methodType   // 本次请求要调用的方法名
 	svc             *service      // 本次请求要调用的服务名
+	ctx             context.Context
+	size            int64         // 请求在连接上占的字节数, codec 不支持统计时为 0
+	read            time.Time     // 读完请求的时间
+	conn            *countingConn // 请求所在的连接, 用来统计响应的字节数
 }
 
 type Server struct {
 	serviceMap sync.Map
+	// Limiter 不为空时, 每个请求在处理之前都要先拿到令牌. 需要在 Accept 之前设置
+	Limiter *RateLimiter
+	// TLSConfig 不为空时, Accept 接收的连接都会先进行 TLS 握手.
+	// 设置 ClientAuth = tls.RequireAndVerifyClientCert 即为双向认证(mTLS)
+	TLSConfig *tls.Config
+	// Authenticator 不为空时, 握手和每次调用都要先通过认证
+	Authenticator Authenticator
+	// Authorizer 不为空时, 检查认证后的身份能否调用对应的方法
+	Authorizer Authorizer
+	// IdleTimeout 大于0时, 超过这个时间没有任何数据往来的连接会被关闭.
+	// 握手没有通过认证的连接发来的数据不算往来, 这样的连接最多保持 IdleTimeout
+	IdleTimeout time.Duration
+	// SpanExporter 不为空时, 每个请求都会记录一个 span
+	SpanExporter SpanExporter
+	// Logger 为空时不输出日志
+	Logger *slog.Logger
+	// AccessLog 不为空时, 每个处理完的请求都会写一条访问日志
+	AccessLog *AccessLog
+	// Recorder 不为空时, 收到的请求和发出的响应都会被录制下来, 可以用 Replayer 回放
+	Recorder *Recorder
+	// Faults 不为空时, 按它的配置在连接上注入故障. 需要在 Accept 之前设置
+	Faults *FaultInjector
+
+	metricsOnce  sync.Once
+	metrics      *serverMetrics
+	errorsOnce   sync.Once
+	recentErrors *errorRing
+	connMu       sync.Mutex
+	conns        map[*serverConnState]struct{}
+	connSeq      uint64
 }
 
+// TLS 握手的最长时间, 防止客户端连上之后什么都不发
+const tlsHandshakeTimeout = 10 * time.Second
+
 // 构造函数, go语言中的结构体没有构造函数, 需要自己实现
 func NewServer() *Server {
-	return &Server{}
+	s := &Server{}
+	_ = s.RegisterName(ReflectionService, &reflectionService{server: s}) // 内置的反射服务
+	return s
 }
 
 var DefaultServer = NewServer()
@@ -83,25 +142,81 @@ var DefaultServer = NewServer()
 // 不是for循环,不可以使用go ,否则父goroutine 退出了,子goroutine也会退出
 func (s *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
-	// 读取option
+	log := s.logger()
+	if nc, ok := conn.(net.Conn); ok {
+		log = log.With("peer", nc.RemoteAddr().String())
+	}
+	metrics := s.loadMetrics()
+	atomic.AddUint64(&metrics.connectionsTotal, 1)
+	atomic.AddInt64(&metrics.connections, 1)
+	defer atomic.AddInt64(&metrics.connections, -1)
+	// 先完成 TLS 握手, 这样才能拿到客户端的证书
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Warn("rpc server: tls handshake failed", "err", err)
+			metrics.handshakeFailed("tls")
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+	}
+	counted := newCountingConn(conn, &metrics.receivedBytes, &metrics.sentBytes)
+	// 读取option. 直接从 counted 的缓冲区读, 读完之后再计数
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("Decode Json Opt Error: ", err.Error())
+	dec := json.NewDecoder(counted.r)
+	if err := dec.Decode(&opt); err != nil {
+		log.Warn("rpc server: decode option failed", "err", err)
+		metrics.handshakeFailed("option")
 		return
 	}
 
 	if opt.MagicNumber != DefaultMagicNumber {
-		log.Println("MagicNumber err: ", opt.MagicNumber)
+		log.Warn("rpc server: invalid magic number", "magic", opt.MagicNumber)
+		metrics.handshakeFailed("magic_number")
 		return
 	}
 
 	createCodecFunc := codec.NewCodecFuncMap[opt.CodecType]
 	if createCodecFunc == nil {
-		log.Println("Not Define CodecFuncType", opt.CodecType)
+		log.Warn("rpc server: invalid codec type", "codec", opt.CodecType)
+		metrics.handshakeFailed("codec")
+		return
+	}
+	log.Debug("rpc server: received option", "codec", opt.CodecType)
+	// json 解码器会预读, 可能已经把后面的请求读进了自己的缓冲区, 交给codec之前要先把这部分数据接上
+	if err := endOption(counted, dec); err != nil {
+		log.Warn("rpc server: read option failed", "err", err)
+		metrics.handshakeFailed("option")
 		return
 	}
-	log.Println("Server: Received Option! codec: ", opt.CodecType)
-	s.serveCodec(createCodecFunc(conn), &opt) // 构造编码器,传入loop
+	peer := newPeer(conn)
+	authErr := s.authenticateConn(peer, &opt, log) // 握手认证失败的连接, 所有请求都会被拒绝
+	st := s.trackConn(peer, opt.CodecType, counted)
+	defer s.untrackConn(st)
+	s.serveCodec(s.Recorder.wrap(s.Faults.wrap(counted, createCodecFunc), st.id), &opt, st, authErr, log) // 构造编码器,传入loop
+}
+
+// endOption 在 json 解码器读完 option 之后调用: 把 option 计入读到的字节数, 解码器预读的数据放回 conn.
+// json.Encoder 会在 option 后面写一个换行符, 要把它跳过, 否则后面的codec会把它当成数据
+func endOption(conn *countingConn, dec *json.Decoder) error {
+	rest, _ := io.ReadAll(dec.Buffered())
+	n := dec.InputOffset()
+	if len(rest) == 0 {
+		b, err := conn.r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			_, _ = conn.r.Discard(1)
+			n++
+		}
+	} else if rest[0] == '\n' {
+		rest = rest[1:]
+		n++
+	}
+	conn.countRead(int(n))
+	conn.pending = rest
+	return nil
 }
 
 var invalidRequest = struct{}{} // 初始化一个空结构体
@@ -117,96 +232,274 @@ var testStruct = TestStruct{
 }
 
 // 三次握手, 发送opt选项之后, 在这里主循环, 接受 request && handle request
-func (s *Server) serveCodec(cc codec.Codec, opt *Option) {
+func (s *Server) serveCodec(cc codec.Codec, opt *Option, st *serverConnState, authErr error, log *slog.Logger) {
 	// defer func() { _ = cc.Close() }() // 退出的时候关闭cc
 	// 同一个conn 连接, 同一时间, 不同goroutine 只能有一个在写
 	sending := &sync.Mutex{} // 每个conn 连接,对应一把锁
 	wg := &sync.WaitGroup{}
+	peer := st.peer
+	st.touch()
+	done := make(chan struct{})
+	defer close(done)
+	if s.IdleTimeout > 0 {
+		go s.watchIdle(cc, st, done)
+	}
 
 	for {
 		// 读取request
+		before := st.conn.bytesRead()
 		req, err := s.readRequest(cc) // 当前协程只负责读区请求
 		// test code
 		// err = errors.New("test err")  // 打开这个注释, 会向客户端发送空结构体,客户端就不能再用string类型的变量去接收了
+		if req == nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Debug("rpc server: read header failed", "err", err)
+		}
+		if req == nil { // header 解析失败,可以退出了 //! 为什么这里break, continue不行吗 //因为tcp是数据流,这里读取失败, 很可能已经发生了粘包,无法再找到下个请求的开始. 也可能是客户端退出了
+			break
+		}
+		// 握手没有通过认证的连接上所有的调用都会被拒绝, 不算活跃, 也不回复心跳, 由 IdleTimeout 关闭
+		if authErr == nil {
+			st.touch()
+		}
+		req.size, req.read, req.conn = st.conn.bytesRead()-before, time.Now(), st.conn
+		if isPing(req.Header) { // 心跳, 直接回复
+			if authErr == nil {
+				s.sendResponse(cc, st.conn, &codec.Header{ServerMethod: heartbeatPong}, invalidRequest, sending, nil)
+			}
+			continue
+		}
+		// 先认证, 再处理读请求时的错误, 避免未认证的调用方探测有哪些服务
+		callPeer, aerr := s.authenticateCall(req, peer, authErr)
+		if aerr != nil {
+			err = aerr
+		}
 		if err != nil {
 			// log.Println("Server: serveCodec: ", err, req)
-			if req == nil { // header 解析失败,可以退出了 //! 为什么这里break, continue不行吗 //因为tcp是数据流,这里读取失败, 很可能已经发生了粘包,无法再找到下个请求的开始. 也可能是客户端退出了
-				break
-			}
-			req.Header.Error = err.Error()
-			s.sendResponse(cc, req.Header, invalidRequest, sending)
+			s.reject(cc, req, err, sending, log, peer)
+			continue
+		}
+		if err := s.checkLimit(req, callPeer); err != nil {
+			s.reject(cc, req, err, sending, log, callPeer)
+			continue
+		}
+		if err := s.Faults.methodError(req.Header.ServerMethod); err != nil {
+			s.reject(cc, req, err, sending, log, callPeer)
+			continue
+		}
+
+		if !req.svc.acquire() { // 服务刚刚被注销了
+			s.reject(cc, req, Errorf(NotFound, "rpc service: can't find service %s", req.svc.name), sending, log, callPeer)
 			continue
 		}
 
+		req.ctx = withIncomingMetadata(withPeer(context.Background(), callPeer), req.Header.Meta)
 		wg.Add(1)
-		go s.handleRequest(cc, req, sending, wg, opt.HandleTimeout) // 处理请求和回复请求在其他协程, 所以每次在写数据的时候都需要加锁
+		atomic.AddInt64(&st.inflight, 1)
+		st.addRequest(req)
+		go func() {
+			s.handleRequest(cc, req, sending, wg, handleTimeout(opt.HandleTimeout, req.mtype.Timeout)) // 处理请求和回复请求在其他协程, 所以每次在写数据的时候都需要加锁
+			st.removeRequest(req)
+			atomic.AddInt64(&st.inflight, -1)
+			st.touch()
+		}()
 	}
 	wg.Wait() // 等所有的协程都处理完了,再关闭连接
-	log.Println("conn close")
+	log.Debug("rpc server: connection closed")
 	cc.Close()
 
 }
 
-// 往cc 连接 发送header 和body, 发送前要申请 sengind mutex
-func (s *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
-	sending.Lock()
-	defer sending.Unlock()
+// 握手认证, 成功后把身份记录到 peer 上
+func (s *Server) authenticateConn(peer *Peer, opt *Option, log *slog.Logger) error {
+	if s.Authenticator == nil {
+		return nil
+	}
+	identity, err := s.Authenticator.Authenticate(&AuthInfo{Peer: peer, Metadata: opt.Auth})
+	if err != nil {
+		log.Warn("rpc server: handshake authentication failed", "err", err)
+		s.loadMetrics().handshakeFailed("auth")
+		return StatusFromError(err)
+	}
+	peer.Identity = identity
+	return nil
+}
 
-	if err := cc.Write(h, body); err != nil {
-		log.Println("sendResponse: Write Error: ", err.Error())
-		return
+// 每次调用的认证和鉴权, 返回带有本次调用身份的 peer
+func (s *Server) authenticateCall(req *request, peer *Peer, authErr error) (*Peer, error) {
+	if authErr != nil {
+		return nil, authErr
+	}
+	identity := peer.Identity
+	if s.Authenticator != nil {
+		var err error
+		identity, err = s.Authenticator.Authenticate(&AuthInfo{
+			Peer:         peer,
+			ServerMethod: req.Header.ServerMethod,
+			Seq:          req.Header.Seq,
+			Metadata:     req.Header.Meta,
+		})
+		if err != nil {
+			return nil, StatusFromError(err)
+		}
+	}
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(identity, req.Header.ServerMethod); err != nil {
+			return nil, StatusFromError(err)
+		}
+	}
+	if identity == peer.Identity {
+		return peer, nil
 	}
+	p := *peer
+	p.Identity = identity
+	return &p, nil
 }
 
-func (s *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	// req.ReplyArgv = reflect.New(reflect.TypeOf(""))
-	defer wg.Done()               // 走完整个处理流程后执行 wg.Done,defer是在本函数退出的时候才执行
-	called := make(chan struct{}) // 防止在call之后,发送response的时候超时, 又发送了一次response
-	sent := make(chan struct{})
+// 限流检查, 没有配置 Limiter 时直接放行
+func (s *Server) checkLimit(req *request, peer *Peer) *RateLimitError {
+	if s.Limiter == nil {
+		return nil
+	}
+	return s.Limiter.allow(limitInfo{Addr: peer.host(), Identity: peer.Identity, ServerMethod: req.Header.ServerMethod})
+}
 
-	go func() {
-		err := req.svc.call(req.mtype, req.Argv, req.ReplyArgv)
-		called <- struct{}{} // 通知已经完成调用
+// reject 回复一个没有进入处理流程的请求
+func (s *Server) reject(cc codec.Codec, req *request, err error, sending *sync.Mutex, log *slog.Logger, peer *Peer) {
+	access := s.AccessLog.begin(req.Argv)
+	setHeaderError(req.Header, err)
+	s.loadRecentErrors().add(req.Header, peer)
+	if log.Enabled(context.Background(), slog.LevelDebug) {
+		log.Debug("rpc server: request rejected", "seq", req.Header.Seq, "method", req.Header.ServerMethod, "err", err)
+	}
+	s.loadMetrics().reject(req.metricsKey(), Code(req.Header.Code))
+	s.sendResponse(cc, req.conn, req.Header, invalidRequest, sending, func(size int64) {
+		access.record(req.Header, peer, req.read, req.size, size, err)
+	})
+}
 
-		if err != nil {
-			req.Header.Error = err.Error()
-			s.sendResponse(cc, req.Header, invalidRequest, sending)
-			sent <- struct{}{}
-		}
-		s.sendResponse(cc, req.Header, req.ReplyArgv.Interface(), sending)
-		sent <- struct{}{}
-	}()
+// 指标里的 service/method 标签, 找不到方法的请求都记在 unknown 下面
+func (req *request) metricsKey() methodKey {
+	if req.mtype == nil {
+		return unknownMethod
+	}
+	return splitMethod(req.Header.ServerMethod)
+}
 
-	if timeout == 0 {
-		<-called
-		<-sent
+// 把错误转换成 Status 写入 header, 客户端据此还原出 *Status
+func setHeaderError(h *codec.Header, err error) {
+	StatusFromError(err).encode(h)
+}
+
+// deferredWriter 由可能在 Write 返回之后才写出响应的 codec 实现, 比如故障注入的延迟和乱序.
+// 响应真正写出(或者被丢弃)之后用写出的字节数调用 sent, 每个响应只调用一次
+type deferredWriter interface {
+	WriteDeferred(h *codec.Header, body interface{}, sent func(size int64)) error
+}
+
+// 往cc 连接 发送header 和body, 发送前要申请 sengind mutex.
+// 响应写出之后, 在 sending 锁外用 conn 上写出的字节数调用 sent, sent 可以为空
+func (s *Server) sendResponse(cc codec.Codec, conn *countingConn, h *codec.Header, body interface{}, sending *sync.Mutex, sent func(size int64)) {
+	sending.Lock()
+	if d, ok := cc.(deferredWriter); ok {
+		if err := d.WriteDeferred(h, body, sent); err != nil {
+			s.logger().Warn("rpc server: write response failed", "seq", h.Seq, "method", h.ServerMethod, "err", err)
+		}
+		sending.Unlock()
 		return
 	}
+	before := conn.bytesWritten()
+	if err := cc.Write(h, body); err != nil {
+		s.logger().Warn("rpc server: write response failed", "seq", h.Seq, "method", h.ServerMethod, "err", err)
+	}
+	size := conn.bytesWritten() - before
+	sending.Unlock()
+	if sent != nil {
+		sent(size)
+	}
+}
 
-	select {
-	case <-time.After(timeout):
-		req.Header.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		s.sendResponse(cc, req.Header, invalidRequest, sending)
-	case <-called:
-		<-sent
+// 客户端要求的超时和注册时声明的超时, 取较小的那个(0 表示不限制)
+func handleTimeout(client, method time.Duration) time.Duration {
+	if client == 0 || (method > 0 && method < client) {
+		return method
 	}
+	return client
+}
 
-	/*
-		// 直接调用对应服务的call 方法
-		err := req.svc.call(req.mtype, req.Argv, req.ReplyArgv)
-		if err != nil {
-			req.Header.Error = err.Error()
-			s.sendResponse(cc, req.Header, invalidRequest, sending)
-			return
-		}
+/*
+一个请求的生命周期:
+1、worker 协程调用 service.call, ctx 在超时的时候会被取消, 方法可以通过 ctx 提前退出
+2、worker 完成 和 超时, 哪个先发生就由哪个发送响应; respond 保证同一个 Seq 只会发送一次响应
+3、超时之后 handleRequest 立即返回, worker 晚些完成时不会再发送, 也不会阻塞在任何 channel 上
+*/
+func (s *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+	defer wg.Done()                                // 走完整个处理流程后执行 wg.Done,defer是在本函数退出的时候才执行
+	req.Header.CallTimeout = req.mtype.CallTimeout // 告诉客户端这个方法默认的调用超时
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.ctx)
+	}
+	defer cancel() // 超时或者处理完成后都取消 ctx, 通知还在运行的方法退出
+
+	key, start, metrics := req.metricsKey(), time.Now(), s.loadMetrics()
+	metrics.begin(key)
+	span := s.startSpan(req)
+	if span != nil {
+		ctx = ContextWithSpanContext(ctx, span.context())
+	}
+	access := s.AccessLog.begin(req.Argv)
+	var once sync.Once
+	// 每次发送都拷贝一份 header, worker 和超时分支不会同时修改同一个 header
+	respond := func(err error, body interface{}) {
+		once.Do(func() {
+			h := *req.Header
+			if err != nil {
+				setHeaderError(&h, err)
+				body = invalidRequest
+			}
+			// 故障注入推迟的响应在真正写出之后才记录, 这时才知道大小
+			s.sendResponse(cc, req.conn, &h, body, sending, func(size int64) {
+				metrics.end(key, Code(h.Code), time.Since(start))
+				p, _ := PeerFromContext(req.ctx)
+				if err != nil {
+					s.loadRecentErrors().add(&h, p)
+				}
+				access.record(&h, p, start, req.size, size, err)
+				if span != nil {
+					span.RequestSize, span.ResponseSize = req.size, size
+					span.finish(s.SpanExporter, err)
+				}
+			})
+		})
+	}
 
-		s.sendResponse(cc, req.Header, req.ReplyArgv.Interface(), sending)
+	done := make(chan struct{}) // 只会被关闭, 没有人接收也不会阻塞
+	go func() {
+		defer close(done)
+		defer req.svc.release() // 方法真正返回之后才算调用结束, Unregister 会等待
+		defer func() {          // 方法 panic 的时候返回 Internal, 不要让整个服务挂掉
+			if r := recover(); r != nil {
+				req.logger(s.logger()).Error("rpc server: method panicked", "panic", r)
+				respond(Errorf(Internal, "rpc server: %s panic: %v", req.Header.ServerMethod, r), nil)
+			}
+		}()
+		err := req.svc.call(ctx, req.mtype, req.Argv, req.ReplyArgv)
+		respond(err, req.ReplyArgv.Interface())
+	}()
 
-		// req.ReplyArgv = reflect.ValueOf(fmt.Sprintf("TeaRpc Replay: %v", req.Header.Seq))
-		// log.Printf("handleRequest: req.Seq=%d, argv=%v, Reply=%s", req.Header.Seq, req.Argv.Elem(), req.ReplyArgv)
-		// // send response
-		// s.sendResponse(cc, req.Header, req.ReplyArgv.Interface(), sending)
-	*/
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			respond(Errorf(DeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout), nil)
+		} else {
+			respond(Errorf(Canceled, "rpc server: request canceled"), nil)
+		}
+	}
 }
 
 /*
@@ -219,8 +512,12 @@ func (s *Server) readRequest(cc codec.Codec) (*request, error) {
 		return nil, err
 	}
 	req := &request{Header: h}
+	if isPing(h) {
+		return req, cc.ReadBody(nil)
+	}
 	req.svc, req.mtype, err = s.findServer(h.ServerMethod) //!这里如果出现问题了, body就不读了么??那下次再读的时候,不会粘包么
 	if err != nil {
+		_ = cc.ReadBody(nil) // 会粘包的, 所以这里要把body读出来丢掉
 		return req, err
 	}
 
@@ -233,8 +530,7 @@ func (s *Server) readRequest(cc codec.Codec) (*request, error) {
 		argvi = req.Argv.Addr().Interface()
 	}
 	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read body err: ", err)
-		return req, err
+		return req, Errorf(InvalidArgument, "rpc server: read body err: %v", err)
 	}
 
 	return req, nil
@@ -253,9 +549,6 @@ func (s *Server) readRequest(cc codec.Codec) (*request, error) {
 func (s *Server) readRequsetHead(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("ReadRequestHead : Read Head Error: ", err.Error(), h)
-		}
 		return nil, err
 	}
 	return &h, nil
@@ -265,13 +558,17 @@ func (s *Server) readRequsetHead(cc codec.Codec) (*codec.Header, error) {
 func (s *Server) Accept(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		log.Println("Server: accpt a new connect: ", conn.RemoteAddr())
-
 		if err != nil {
-			log.Println("Accept Error: ", listener.Addr().String(), err.Error())
+			if errors.Is(err, net.ErrClosed) { // listener 已经关闭, 退出主循环
+				return
+			}
+			s.logger().Error("rpc server: accept failed", "addr", listener.Addr().String(), "err", err)
 			continue
 		}
-		log.Println("Server: Accpt ", conn.RemoteAddr().String())
+		s.logger().Debug("rpc server: accepted connection", "peer", conn.RemoteAddr().String())
+		if s.TLSConfig != nil {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
 		go s.ServeConn(conn)
 	}
 }
@@ -280,33 +577,88 @@ func Accept(listener net.Listener) {
 	DefaultServer.Accept(listener)
 }
 
-func (s *Server) Register(rcvr interface{}) error {
-	server := newService(rcvr)
+// Register 以接收者的类型名注册服务, 发布其中所有符合条件的导出方法.
+// opts 可以声明服务级别和方法级别的超时
+func (s *Server) Register(rcvr interface{}, opts ...ServiceOption) error {
+	return s.register("", rcvr, opts)
+}
+
+// RegisterName 和 Register 一样, 但是用 name 作为服务名, 同一个类型可以注册多个实例.
+// name 不能为空, 不能含空白和 '/'
+func (s *Server) RegisterName(name string, rcvr interface{}, opts ...ServiceOption) error {
+	if rcvr == nil {
+		return errors.New("rpc server: register nil receiver")
+	}
+	if name == "" {
+		return errors.New("rpc server: no service name for type " + reflect.TypeOf(rcvr).String())
+	}
+	return s.register(name, rcvr, opts)
+}
+
+func (s *Server) register(name string, rcvr interface{}, opts []ServiceOption) error {
+	o := newServiceOptions(opts)
+	server, err := newService(name, rcvr)
+	if server != nil && o.skipped != nil {
+		*o.skipped = append((*o.skipped)[:0], server.skipped...)
+	}
+	if err != nil {
+		return err
+	}
+	if o.strict && len(server.skipped) > 0 {
+		return &RegistrationError{Service: server.name, Reason: "methods skipped in strict mode", Skipped: server.skipped}
+	}
+	if err := server.apply(o); err != nil {
+		return err
+	}
 	if _, dup := s.serviceMap.LoadOrStore(server.name, server); dup {
 		return errors.New("rpc: serivce already defined: " + server.name)
 	}
+	log := s.logger().With("service", server.name)
+	for _, m := range server.skipped {
+		log.Info("rpc server: skipped method", "method", m.Method, "reason", m.Reason)
+	}
+	log.Debug("rpc server: registered service", "methods", len(server.method))
 	return nil
 }
 
-func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
+// Unregister 注销名为 name 的服务, 之后的调用立即返回 NotFound, 等正在进行的调用结束后才返回.
+// 等待没有时限: 不理会 ctx 、一直不返回的方法会让 Unregister 永远阻塞
+func (s *Server) Unregister(name string) error {
+	svci, ok := s.serviceMap.LoadAndDelete(name)
+	if !ok {
+		return Errorf(NotFound, "rpc server: can't find service %s", name)
+	}
+	svci.(*service).close()
+	return nil
+}
+
+func Register(rcvr interface{}, opts ...ServiceOption) error {
+	return DefaultServer.Register(rcvr, opts...)
+}
+
+func RegisterName(name string, rcvr interface{}, opts ...ServiceOption) error {
+	return DefaultServer.RegisterName(name, rcvr, opts...)
+}
+
+func Unregister(name string) error { return DefaultServer.Unregister(name) }
 
 func (s *Server) findServer(serviceMthod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMthod, ".")
 	if dot < 0 {
-		err = errors.New("rpc service: service/method request ill-formed: " + serviceMthod)
+		err = Errorf(InvalidArgument, "rpc service: service/method request ill-formed: %s", serviceMthod)
 		return
 	}
 
 	serviceName, methodName := serviceMthod[:dot], serviceMthod[dot+1:]
 	svci, ok := s.serviceMap.Load(serviceName) // Load函数返回的是interface, 需要断言
 	if !ok {
-		err = errors.New("rpc service: can't find service " + serviceName)
+		err = Errorf(NotFound, "rpc service: can't find service %s", serviceName)
 		return
 	}
 	svc = svci.(*service) // 断言为对应的服务指针
-	mtype = svc.method[methodName]
+	mtype = svc.lookup(methodName)
 	if mtype == nil { // mtype是个指针类型
-		err = errors.New("rpc service: can't find method " + methodName)
+		err = Errorf(NotFound, "rpc service: can't find method %s", methodName)
 		return
 	}
 	return
@@ -325,7 +677,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	conn, _, err := w.(http.Hijacker).Hijack() // 接管http服务
 
 	if err != nil {
-		log.Print("rpc hijacking ,", req.RemoteAddr, ": ", err.Error())
+		s.logger().Warn("rpc server: hijack failed", "peer", req.RemoteAddr, "err", err)
 		return
 	}
 
@@ -0,0 +1,133 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"tearpc/codec"
+	"testing"
+	"time"
+)
+
+// countCodec 记录每个 Seq 被写了几次响应
+type countCodec struct {
+	mu     sync.Mutex
+	writes map[uint64]int
+	errs   map[uint64]string
+}
+
+func newCountCodec() *countCodec {
+	return &countCodec{writes: make(map[uint64]int), errs: make(map[uint64]string)}
+}
+
+func (c *countCodec) Close() error                   { return nil }
+func (c *countCodec) ReadHeader(*codec.Header) error { return nil }
+func (c *countCodec) ReadBody(interface{}) error     { return nil }
+func (c *countCodec) Write(h *codec.Header, _ interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes[h.Seq]++
+	c.errs[h.Seq] = h.Error
+	return nil
+}
+
+type Lifecycle int
+
+func (l Lifecycle) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (l Lifecycle) Fail(_ int, reply *int) error { return errors.New("failed") }
+
+func (l Lifecycle) Panic(_ int, reply *int) error { panic("boom") }
+
+var canceled int32
+
+func (l Lifecycle) Wait(ctx context.Context, _ int, reply *int) error {
+	<-ctx.Done()
+	atomic.AddInt32(&canceled, 1)
+	return ctx.Err()
+}
+
+func newLifecycleRequest(svc *service, seq uint64, method string, arg interface{}) *request {
+	mtype := svc.method[method]
+	req := &request{
+		Header:    &codec.Header{ServerMethod: "Lifecycle." + method, Seq: seq},
+		svc:       svc,
+		mtype:     mtype,
+		Argv:      mtype.newArgv(),
+		ReplyArgv: mtype.newReplyv(),
+		ctx:       context.Background(),
+	}
+	req.Argv.Set(reflect.ValueOf(arg))
+	svc.acquire()
+	return req
+}
+
+func TestServer_HandleRequestRespondsOnce(t *testing.T) {
+	var l Lifecycle
+	svc, _ := newService("", &l)
+	s := NewServer()
+	cc := newCountCodec()
+	wg := &sync.WaitGroup{}
+	sending := &sync.Mutex{}
+
+	reqs := []*request{
+		newLifecycleRequest(svc, 1, "Sleep", 50*time.Millisecond), // 超时之后才完成
+		newLifecycleRequest(svc, 2, "Fail", 0),
+		newLifecycleRequest(svc, 3, "Panic", 0),
+		newLifecycleRequest(svc, 4, "Sleep", time.Duration(0)),
+	}
+	for _, req := range reqs {
+		wg.Add(1)
+		go s.handleRequest(cc, req, sending, wg, 10*time.Millisecond)
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond) // 等超时的请求真正完成
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for seq := uint64(1); seq <= 4; seq++ {
+		_assert(cc.writes[seq] == 1, "seq %d: expect exactly one response, got %d", seq, cc.writes[seq])
+	}
+	_assert(cc.errs[1] != "" && cc.errs[2] == "failed" && cc.errs[3] != "" && cc.errs[4] == "", "wrong errors: %v", cc.errs)
+}
+
+func TestServer_NoGoroutineLeakOnTimeout(t *testing.T) {
+	s := NewServer()
+	var l Lifecycle
+	_ = s.Register(&l, WithMethodTimeout("Wait", 5*time.Millisecond), WithMethodTimeout("Sleep", 5*time.Millisecond))
+	client, done := dialTestServer(s)
+	defer done()
+
+	before := runtime.NumGoroutine()
+	atomic.StoreInt32(&canceled, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			var err error
+			if i%2 == 0 {
+				err = client.Call(context.Background(), "Lifecycle.Wait", 0, &reply)
+			} else {
+				err = client.Call(context.Background(), "Lifecycle.Sleep", 200*time.Millisecond, &reply)
+			}
+			_assert(errors.Is(err, DeadlineExceeded), "expect a timeout, got %v", err)
+		}(i)
+	}
+	wg.Wait()
+
+	// 超时之后还在运行的方法结束后, 不应该有协程残留
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(runtime.NumGoroutine() <= before+5, "goroutines leaked: before %d, after %d", before, runtime.NumGoroutine())
+	_assert(atomic.LoadInt32(&canceled) == 100, "handler contexts should be canceled on timeout")
+}
@@ -1,10 +1,16 @@
 package tearpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+	"unicode"
 )
 
 // 封装一个服务类的方法 "Service.Method" 中的method
@@ -13,6 +19,12 @@ type methodType struct {
 	ArgType   reflect.Type   // 第一个参数类型
 	ReplyType reflect.Type   // 第二个参数类型
 	numCalls  uint64         // 接口被调用的次数
+	withCtx   bool           // 第一个参数是否为 context.Context
+	fn        reflect.Value  // 通过 RegisterFunc 注册的普通函数, 此时 method 为空
+	// Timeout 服务端处理这个方法的最长时间, 不管客户端怎么设置都会生效. 0 表示不限制
+	Timeout time.Duration
+	// CallTimeout 客户端调用这个方法的默认超时时间, 调用方的 ctx 没有设置 deadline 时生效
+	CallTimeout time.Duration
 }
 
 // 因为包含非原始类型,这里使用指针
@@ -48,36 +60,231 @@ func (m *methodType) newReplyv() reflect.Value {
 		replyv.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
 	}
 
-	log.Println("newReplyv: replyv", replyv)
 	return replyv
 }
 
+// ServiceOption configures a service at Register time.
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	timeout            time.Duration
+	callTimeout        time.Duration
+	methodTimeouts     map[string]time.Duration
+	methodCallTimeouts map[string]time.Duration
+	strict             bool
+	skipped            *[]SkippedMethod
+}
+
+func newServiceOptions(opts []ServiceOption) *serviceOptions {
+	o := &serviceOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Strict makes Register fail with a *RegistrationError when any exported
+// method of the receiver is skipped because of its signature.
+func Strict() ServiceOption {
+	return func(o *serviceOptions) { o.strict = true }
+}
+
+// ReportSkipped stores in dst the exported methods Register skipped, and why.
+func ReportSkipped(dst *[]SkippedMethod) ServiceOption {
+	return func(o *serviceOptions) { o.skipped = dst }
+}
+
+// SkippedMethod is an exported method that was not registered.
+type SkippedMethod struct {
+	Method string
+	Reason string
+}
+
+// RegistrationError reports a service that could not be registered, with
+// the methods that were skipped.
+type RegistrationError struct {
+	Service string
+	Reason  string
+	Skipped []SkippedMethod
+}
+
+func (e *RegistrationError) Error() string {
+	var b strings.Builder
+	b.WriteString("rpc server: service " + e.Service + ": " + e.Reason)
+	for _, m := range e.Skipped {
+		b.WriteString("; " + m.Method + " " + m.Reason)
+	}
+	return b.String()
+}
+
+// WithTimeout limits the execution time of every method of the service.
+// The server enforces it whatever HandleTimeout the client asks for.
+func WithTimeout(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) { o.timeout = d }
+}
+
+// WithMethodTimeout limits the execution time of one method, overriding WithTimeout.
+func WithMethodTimeout(method string, d time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		if o.methodTimeouts == nil {
+			o.methodTimeouts = make(map[string]time.Duration)
+		}
+		o.methodTimeouts[method] = d
+	}
+}
+
+// WithCallTimeout sets the default client-side timeout of every method of
+// the service. It is advertised to clients in responses and through the
+// reflection service, and applies to calls made without a context deadline,
+// including calls made with Go. Clients with Option.LoadCallTimeouts know
+// it from the first call; others learn it from the first response.
+func WithCallTimeout(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) { o.callTimeout = d }
+}
+
+// WithMethodCallTimeout sets the default client-side timeout of one method.
+func WithMethodCallTimeout(method string, d time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		if o.methodCallTimeouts == nil {
+			o.methodCallTimeouts = make(map[string]time.Duration)
+		}
+		o.methodCallTimeouts[method] = d
+	}
+}
+
+// 把注册时的配置应用到每个方法上, 配置了不存在的方法时返回错误
+func (s *service) apply(o *serviceOptions) error {
+	for _, m := range s.method {
+		m.Timeout, m.CallTimeout = o.timeout, o.callTimeout
+	}
+	for name, d := range o.methodTimeouts {
+		m, ok := s.method[name]
+		if !ok {
+			return fmt.Errorf("rpc server: timeout set for unknown method %s.%s", s.name, name)
+		}
+		m.Timeout = d
+	}
+	for name, d := range o.methodCallTimeouts {
+		m, ok := s.method[name]
+		if !ok {
+			return fmt.Errorf("rpc server: call timeout set for unknown method %s.%s", s.name, name)
+		}
+		m.CallTimeout = d
+	}
+	return nil
+}
+
 // 定义service
 type service struct {
 	name   string                 // 提供服务的结构体的名字,比如MathService
 	typ    reflect.Type           // 结构体的类型定义,提供服务的结构体
 	rcvr   reflect.Value          // receiver 实例本身, 通常作为方法的第一个参数
 	method map[string]*methodType // 函数名,映射到具体的接口: "add" -> add(param1, *param2) 存储映射的结构体的所有符合条件的方法
+	funcs  bool                   // 由 RegisterFunc 注册的普通函数组成的服务, 没有接受者
+	// skipped 因为签名不符合要求而没有注册的导出方法
+	skipped []SkippedMethod
+
+	mu       sync.RWMutex   // 保护 closed 和 method, 保证 closed 之后不会再有 inflight.Add
+	closed   bool           // 已经被注销
+	inflight sync.WaitGroup // 正在进行的调用
 }
 
-// 定义构造函数
-func newService(rcvr interface{}) *service {
+// 定义构造函数, name 为空时使用接受者的类型名作为服务名
+func newService(name string, rcvr interface{}) (*service, error) {
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
+	if !s.rcvr.IsValid() || (s.rcvr.Kind() == reflect.Ptr && s.rcvr.IsNil()) {
+		return nil, errors.New("rpc server: register nil receiver")
+	}
 	s.typ = reflect.TypeOf(rcvr)
-	// 判断当前服务类是不是导出的
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+	s.name = name
+	if s.name == "" {
+		s.name = reflect.Indirect(s.rcvr).Type().Name()
+		// 判断当前服务类是不是导出的
+		if !ast.IsExported(s.name) {
+			return nil, fmt.Errorf("rpc server: %s is not a valid service name", s.typ)
+		}
+	}
+	if !validServiceName(s.name) {
+		return nil, fmt.Errorf("rpc server: %q is not a valid service name", s.name)
 	}
 	s.registerMetods()
-	return s
+	if len(s.method) == 0 {
+		return s, &RegistrationError{
+			Service: s.name,
+			Reason:  fmt.Sprintf("type %s has no exported methods of suitable type", s.typ),
+			Skipped: s.skipped,
+		}
+	}
+	return s, nil
+}
+
+// 服务名会拼进 "服务名.方法名" 里, 不能为空, 不能含空白和 '/', 也不能以 '.' 结尾
+func validServiceName(name string) bool {
+	return name != "" && !strings.HasSuffix(name, ".") &&
+		strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '/' }) < 0
+}
+
+// acquire 标记一个调用开始, 服务已经被注销时返回 false
+func (s *service) acquire() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
 }
 
+func (s *service) release() { s.inflight.Done() }
+
+// close 之后不再接受新的调用, 并等待正在进行的调用结束
+func (s *service) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.inflight.Wait()
+}
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == "" //导出或者内置类型
 }
 
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// checkMethod 检查方法的签名, first 是第一个参数(ctx 或者 args)的下标: 方法为1(跳过接受者), 函数为0
+// 合法的签名: (args, *reply) error 或者 (ctx context.Context, args, *reply) error
+func checkMethod(mType reflect.Type, first int) (argType, replyType reflect.Type, withCtx bool, err error) {
+	withCtx = mType.NumIn() == first+3 && mType.In(first) == typeOfContext
+	if mType.NumIn() != first+2 && !withCtx {
+		return nil, nil, false, fmt.Errorf("has %d arguments, want (args, *reply) or (ctx, args, *reply)", mType.NumIn()-first)
+	}
+	if mType.NumOut() != 1 {
+		return nil, nil, false, fmt.Errorf("has %d results, want 1", mType.NumOut())
+	}
+	// 把nil转换为error指针类型,然后再利用TypeOf获取其类型(指针), 再通过Elem获取类型(error)
+	// 返回值必须是error类型
+	if mType.Out(0) != typeOfError {
+		return nil, nil, false, fmt.Errorf("returns %s, not error", mType.Out(0))
+	}
+	if withCtx {
+		first++
+	}
+	argType, replyType = mType.In(first), mType.In(first+1)
+	if !isExportedOrBuiltinType(argType) {
+		return nil, nil, false, fmt.Errorf("argument type %s is not exported", argType)
+	}
+	if replyType.Kind() != reflect.Ptr {
+		return nil, nil, false, fmt.Errorf("reply type %s is not a pointer", replyType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return nil, nil, false, fmt.Errorf("reply type %s is not exported", replyType)
+	}
+	return argType, replyType, withCtx, nil
+}
+
 func (s *service) registerMetods() {
 
 	s.method = make(map[string]*methodType)
@@ -86,17 +293,10 @@ func (s *service) registerMetods() {
 		method := s.typ.Method(i)
 		mType := method.Type //?方法也有type
 		// 过滤掉不符合要求的接口. 输入参数必须为3️(其中第一个是接受者, 第二个是请求,第三个是指向响应的指针), 返回类型是一个:error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		// 把nil转换为error指针类型,然后再利用TypeOf获取其类型(指针), 再通过Elem获取类型(error)
-		// 返回值必须是error类型
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() { //? 这里难道不能直接指定是error类型吗?
-			continue
-		}
-
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// 也可以在接受者后面多一个 context.Context 参数: func (t *T) Method(ctx context.Context, args, *reply) error
+		argType, replyType, withCtx, err := checkMethod(mType, 1)
+		if err != nil { // 记录下来, 而不是默默跳过, 否则要到调用的时候才发现 "can't find method"
+			s.skipped = append(s.skipped, SkippedMethod{Method: method.Name, Reason: err.Error()})
 			continue
 		}
 		s.method[method.Name] = &methodType{
@@ -104,16 +304,44 @@ func (s *service) registerMetods() {
 			ArgType:   argType,
 			ReplyType: replyType,
 			numCalls:  0, //
+			withCtx:   withCtx,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// lookup 查找方法, 函数服务运行时还会增加方法, 所以要加锁
+func (s *service) lookup(name string) *methodType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.method[name]
+}
+
+// methods 返回方法表的拷贝
+func (s *service) methods() map[string]*methodType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	methods := make(map[string]*methodType, len(s.method))
+	for name, m := range s.method {
+		methods[name] = m
+	}
+	return methods
+}
+
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
 	// 这里的参数输入是[]reflect.Value的形式 用argv 和replyv做初始参数; 返回参数也是个[]reflect.Value
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	var in []reflect.Value
+	if m.fn.IsValid() { // 普通函数没有接受者
+		f = m.fn
+	} else {
+		in = append(in, s.rcvr)
+	}
+	if m.withCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv, replyv)
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil { // 如果正常发生,返回的应该是nil,否则将其转换为error类型
 		return errInter.(error) // 接口断言
 	}
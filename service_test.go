@@ -1,9 +1,14 @@
 package tearpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -28,7 +33,7 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo // 定义一个服务类的实例
-	s := newService(&foo)
+	s, _ := newService("", &foo)
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum should not be nil")
@@ -36,12 +41,86 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService("", &foo)
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 3, Num2: 6}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 9 && mType.numCalls == 1, "failed to call Foo.Sum")
 }
+
+type unexportedSvc int
+
+func (u unexportedSvc) Sum(args Args, reply *int) error { return nil }
+
+func TestServer_RegisterName(t *testing.T) {
+	s := NewServer()
+	var u unexportedSvc
+	_assert(s.Register(&u) != nil, "unexported service types must be rejected with an error")
+	_assert(s.Register(nil) != nil, "nil receivers must be rejected")
+	_assert(s.RegisterName("tenant-a.Foo", &u) == nil, "explicit names may be used for any type")
+
+	var a, b Sleeper
+	_assert(s.RegisterName("SleeperA", &a) == nil && s.RegisterName("SleeperB", &b) == nil,
+		"two instances of one type should be registered under different names")
+	_assert(s.RegisterName("SleeperA", &b) != nil, "duplicate names must be rejected")
+	_assert(s.RegisterName("", nil) != nil && s.RegisterName("Nil", nil) != nil, "nil receivers must be rejected")
+	for _, name := range []string{"", " ", "Sleeper C", "Sleeper\tC", "tenant/Sleeper", "Sleeper."} {
+		_assert(s.RegisterName(name, &b) != nil, "invalid service name %q must be rejected", name)
+	}
+
+	client, done := dialTestServer(s)
+	defer done()
+	var reply int
+	_assert(client.Call(context.Background(), "tenant-a.Foo.Sum", Args{}, &reply) == nil, "call by explicit name failed")
+
+	// Unregister 要等正在进行的调用结束
+	callDone := make(chan error, 1)
+	go func() {
+		callDone <- client.Call(context.Background(), "SleeperA.Sleep", 200*time.Millisecond, &reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_assert(s.Unregister("SleeperA") == nil, "unregister failed")
+	_assert(time.Since(start) > 100*time.Millisecond, "Unregister should wait for calls in flight")
+	_assert(<-callDone == nil, "the call in flight should complete")
+
+	err := client.Call(context.Background(), "SleeperA.Sleep", time.Duration(0), &reply)
+	_assert(errors.Is(err, NotFound), "unregistered services are not found, got %v", err)
+	_assert(client.Call(context.Background(), "SleeperB.Sleep", time.Duration(0), &reply) == nil, "SleeperB should still work")
+	_assert(errors.Is(s.Unregister("SleeperA"), NotFound), "second unregister should fail")
+}
+
+type Typos int
+
+func (t Typos) Good(args Args, reply *int) error      { return nil }
+func (t Typos) NoReplyPtr(args Args, reply int) error { return nil }
+func (t Typos) NoError(args Args, reply *int) int     { return 0 }
+func (t Typos) TooFew(args Args) error                { return nil }
+func (t Typos) Hidden(args s1, reply *int) error      { return nil }
+
+func TestServer_RegisterDiagnostics(t *testing.T) {
+	s := NewServer()
+	var typos Typos
+	var skipped []SkippedMethod
+	_assert(s.Register(&typos, ReportSkipped(&skipped)) == nil, "non-strict register should succeed")
+	_assert(len(skipped) == 4, "expect 4 skipped methods, got %v", skipped)
+	reasons := map[string]string{}
+	for _, m := range skipped {
+		reasons[m.Method] = m.Reason
+	}
+	_assert(strings.Contains(reasons["NoReplyPtr"], "not a pointer"), "wrong reason: %v", reasons)
+	_assert(strings.Contains(reasons["NoError"], "not error"), "wrong reason: %v", reasons)
+	_assert(strings.Contains(reasons["TooFew"], "arguments"), "wrong reason: %v", reasons)
+	_assert(strings.Contains(reasons["Hidden"], "not exported"), "wrong reason: %v", reasons)
+
+	err := s.RegisterName("Strict", &typos, Strict())
+	var rerr *RegistrationError
+	_assert(errors.As(err, &rerr) && len(rerr.Skipped) == 4, "strict mode should fail, got %v", err)
+
+	w := httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "NoReplyPtr"), "debug page should show skipped methods")
+}
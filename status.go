@@ -0,0 +1,254 @@
+package tearpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"tearpc/codec"
+	"time"
+)
+
+/*
+错误码: 服务端把 error 转换为 Status(错误码 + 错误信息 + 附加信息), 写到 header 里面;
+客户端再从 header 中还原出 *Status, 调用方可以用 errors.Is / errors.As 判断错误类型:
+
+	err := client.Call(ctx, "Foo.Get", args, &reply)
+	if errors.Is(err, tearpc.NotFound) { ... }
+	var st *tearpc.Status
+	if errors.As(err, &st) { log.Println(st.Code, st.Message, st.Details) }
+*/
+
+// Code is the numeric status code of an RPC error. Code values are part of
+// the wire protocol and must never be renumbered.
+type Code uint32
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Error lets a bare Code be used as the target of errors.Is:
+//
+//	errors.Is(err, tearpc.NotFound)
+func (c Code) Error() string { return "rpc error: code = " + c.String() }
+
+// Status is an RPC error made of a code, a message and optional typed
+// details. Handlers return it (usually through Errorf) to control what the
+// client sees; the client reconstructs it from the response header.
+type Status struct {
+	Code    Code
+	Message string
+	Details []interface{}
+	cause   error // 本地错误的原因, 不会在网络上传输
+}
+
+// NewStatus returns a Status with the given code and message.
+func NewStatus(code Code, msg string) *Status {
+	return &Status{Code: code, Message: msg}
+}
+
+// Errorf returns an error carrying a Status with the given code.
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// WithDetails returns a copy of s with details appended. The dynamic type
+// of each detail must be registered with RegisterDetail on the client to
+// be reconstructed there.
+func (s *Status) WithDetails(details ...interface{}) *Status {
+	st := *s
+	st.Details = append(append([]interface{}(nil), s.Details...), details...)
+	return &st
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code.String(), s.Message)
+}
+
+// Is reports whether target is the same Code, or a Status with the same
+// code (and the same message, if target has one).
+func (s *Status) Is(target error) bool {
+	switch t := target.(type) {
+	case Code:
+		return s.Code == t
+	case *Status:
+		return s.Code == t.Code && (t.Message == "" || s.Message == t.Message)
+	}
+	return false
+}
+
+func (s *Status) Unwrap() error { return s.cause }
+
+// StatusFromError converts any error into a Status. Errors that already
+// carry a Status are returned as is, context errors map to Canceled and
+// DeadlineExceeded, and everything else becomes Unknown.
+func StatusFromError(err error) *Status {
+	if err == nil {
+		return nil
+	}
+	var st *Status
+	if errors.As(err, &st) {
+		return st
+	}
+	var se interface{ Status() *Status }
+	if errors.As(err, &se) {
+		return se.Status()
+	}
+	var code Code
+	if errors.As(err, &code) {
+		return &Status{Code: code, Message: err.Error(), cause: err}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Status{Code: DeadlineExceeded, Message: err.Error(), cause: err}
+	case errors.Is(err, context.Canceled):
+		return &Status{Code: Canceled, Message: err.Error(), cause: err}
+	}
+	return &Status{Code: Unknown, Message: err.Error(), cause: err}
+}
+
+// CodeOf returns the status code of err, OK for nil.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return StatusFromError(err).Code
+}
+
+// RetryInfo tells the client how long to wait before retrying.
+type RetryInfo struct {
+	RetryAfter time.Duration
+}
+
+// ErrorInfo describes the cause of an error in a machine readable way.
+type ErrorInfo struct {
+	Reason   string
+	Metadata map[string]string
+}
+
+// UnknownDetail holds a detail whose type is not registered on the client.
+type UnknownDetail struct {
+	Type string
+	Data json.RawMessage
+}
+
+// detail 类型注册表, 类似 gob.Register: 名字 -> 类型
+var detailTypes sync.Map
+
+func init() {
+	RegisterDetail(RetryInfo{})
+	RegisterDetail(ErrorInfo{})
+}
+
+// RegisterDetail records the type of v so that status details of this type
+// can be decoded on the client. Both pointer and value details decode to
+// the value type.
+func RegisterDetail(v interface{}) {
+	t := reflect.Indirect(reflect.ValueOf(v)).Type()
+	detailTypes.Store(detailName(t), t)
+}
+
+func detailName(t reflect.Type) string {
+	if t.PkgPath() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// 把 Status 写入 header, detail 统一编码成json, 跟具体使用哪种codec无关
+func (s *Status) encode(h *codec.Header) {
+	h.Code = uint32(s.Code)
+	h.Error = s.Message
+	h.Details = nil
+	for _, d := range s.Details {
+		if u, ok := d.(*UnknownDetail); ok { // 透传
+			h.Details = append(h.Details, codec.Detail{Type: u.Type, Data: u.Data})
+			continue
+		}
+		switch ri := d.(type) { // 值和指针都要认, 否则客户端拿不到 RetryAfter
+		case RetryInfo:
+			h.RetryAfter = ri.RetryAfter
+		case *RetryInfo:
+			if ri == nil {
+				continue
+			}
+			h.RetryAfter = ri.RetryAfter
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			continue
+		}
+		t := reflect.Indirect(reflect.ValueOf(d)).Type()
+		h.Details = append(h.Details, codec.Detail{Type: detailName(t), Data: data})
+	}
+}
+
+// 从 header 中还原 Status, 没有错误时返回 nil
+func decodeStatus(h *codec.Header) *Status {
+	if h.Code == uint32(OK) && h.Error == "" {
+		return nil
+	}
+	st := &Status{Code: Code(h.Code), Message: h.Error}
+	if st.Code == OK { // 老版本的服务端只会填 Error 字段
+		st.Code = Unknown
+	}
+	for _, d := range h.Details {
+		ti, ok := detailTypes.Load(d.Type)
+		if !ok {
+			st.Details = append(st.Details, &UnknownDetail{Type: d.Type, Data: d.Data})
+			continue
+		}
+		v := reflect.New(ti.(reflect.Type))
+		if err := json.Unmarshal(d.Data, v.Interface()); err != nil {
+			st.Details = append(st.Details, &UnknownDetail{Type: d.Type, Data: d.Data})
+			continue
+		}
+		st.Details = append(st.Details, v.Elem().Interface())
+	}
+	return st
+}
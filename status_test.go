@@ -0,0 +1,80 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"tearpc/codec"
+	"testing"
+	"time"
+)
+
+type Store int
+
+type NotFoundInfo struct {
+	Key string
+}
+
+func (s Store) Get(key string, reply *string) error {
+	switch key {
+	case "plain":
+		return errors.New("plain error 100%")
+	case "slow":
+		time.Sleep(time.Second)
+		return nil
+	}
+	return NewStatus(NotFound, "no such key: "+key+" (100%)").WithDetails(NotFoundInfo{Key: key})
+}
+
+func TestStatus_Is(t *testing.T) {
+	err := Errorf(NotFound, "key %s", "a")
+	_assert(errors.Is(err, NotFound) && !errors.Is(err, Internal), "Is should compare codes")
+	_assert(errors.Is(err, NewStatus(NotFound, "")), "empty message matches any message")
+	_assert(CodeOf(errors.New("x")) == Unknown && CodeOf(nil) == OK, "wrong default codes")
+	_assert(CodeOf(context.DeadlineExceeded) == DeadlineExceeded, "ctx errors map to DeadlineExceeded")
+}
+
+func TestStatus_Error(t *testing.T) {
+	got := Errorf(NotFound, "x").Error()
+	_assert(got == "rpc error: code = NotFound desc = x", "unexpected error text %q", got)
+	_assert(Code(99).Error() == "rpc error: code = Code(99)", "unexpected code text %q", Code(99).Error())
+}
+
+func TestStatus_RoundTrip(t *testing.T) {
+	RegisterDetail(NotFoundInfo{})
+	s := NewServer()
+	var store Store
+	_ = s.Register(&store)
+	client, done := dialTestServer(s)
+	defer done()
+
+	var reply string
+	err := client.Call(context.Background(), "Store.Get", "abc", &reply)
+	var st *Status
+	_assert(errors.As(err, &st) && st.Code == NotFound, "expect NotFound, got %v", err)
+	_assert(st.Message == "no such key: abc (100%)", "message mangled: %q", st.Message)
+	_assert(len(st.Details) == 1 && st.Details[0] == NotFoundInfo{Key: "abc"}, "details lost: %v", st.Details)
+
+	err = client.Call(context.Background(), "Store.Get", "plain", &reply)
+	_assert(errors.Is(err, Unknown) && StatusFromError(err).Message == "plain error 100%", "expect Unknown, got %v", err)
+
+	err = client.Call(context.Background(), "Store.Nope", "abc", &reply)
+	_assert(errors.Is(err, NotFound), "unknown method should be NotFound, got %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "Store.Get", "slow", &reply)
+	_assert(errors.Is(err, DeadlineExceeded) && errors.Is(err, context.DeadlineExceeded), "expect DeadlineExceeded, got %v", err)
+}
+
+func TestStatus_EncodeRetryInfo(t *testing.T) {
+	for _, d := range []interface{}{RetryInfo{RetryAfter: time.Second}, &RetryInfo{RetryAfter: time.Second}} {
+		var h codec.Header
+		NewStatus(ResourceExhausted, "slow down").WithDetails(d).encode(&h)
+		_assert(h.RetryAfter == time.Second && len(h.Details) == 1, "%T detail lost: %+v", d, h)
+		st := decodeStatus(&h)
+		_assert(len(st.Details) == 1 && st.Details[0] == RetryInfo{RetryAfter: time.Second}, "unexpected details %v", st.Details)
+	}
+	var h codec.Header
+	NewStatus(ResourceExhausted, "slow down").WithDetails((*RetryInfo)(nil)).encode(&h)
+	_assert(h.RetryAfter == 0 && len(h.Details) == 0, "a nil detail must be skipped: %+v", h)
+}
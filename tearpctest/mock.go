@@ -0,0 +1,264 @@
+package tearpctest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"tearpc"
+	"testing"
+	"time"
+)
+
+/*
+Mock 是一个按预期回复的服务端, 用来测试调用方的代码, 不需要运行真正的服务:
+
+	mock := tearpctest.NewMock(t)
+	tearpctest.On[Args, int](mock, "Arith.Add").WithArgs(Args{1, 2}).Return(3)
+	tearpctest.On[Args, int](mock, "Arith.Add").ReturnError(tearpc.Errorf(tearpc.Unavailable, "down")).Times(2)
+	client := mock.Client()              // 进程内连接, 或者 tearpc.Dial("tcp", mock.Listen("tcp", "127.0.0.1:0"))
+
+每个调用按注册的顺序找第一个参数匹配, 并且次数没有用完的预期. 找不到时调用返回 Unimplemented, 测试失败.
+测试结束时检查每个预期的调用次数, 也可以提前调用 Verify
+*/
+
+// Mock is a server answering calls from expectations.
+type Mock struct {
+	tb     testing.TB
+	server *tearpc.Server
+
+	mu       sync.Mutex
+	types    map[string][2]reflect.Type // "Service.Method" -> 参数和返回值的类型
+	expects  []*expectation
+	listener *tearpc.PipeListener
+}
+
+// NewMock returns a mock whose expectations are verified when the test ends.
+func NewMock(tb testing.TB) *Mock {
+	m := &Mock{tb: tb, server: tearpc.NewServer(), types: make(map[string][2]reflect.Type)}
+	tb.Cleanup(m.Verify)
+	return m
+}
+
+// Server returns the server the methods are registered on, e.g. to set an
+// Authenticator or serve it some other way.
+func (m *Mock) Server() *tearpc.Server { return m.server }
+
+// Client returns a client connected to the mock in memory.
+func (m *Mock) Client(opts ...*tearpc.Option) *tearpc.Client {
+	m.tb.Helper()
+	m.mu.Lock()
+	if m.listener == nil {
+		m.listener = Serve(m.tb, m.server)
+	}
+	l := m.listener
+	m.mu.Unlock()
+	return Dial(m.tb, l, opts...)
+}
+
+// Listen serves the mock on a real listener until the test ends and returns
+// its address, for code that dials by itself.
+func (m *Mock) Listen(network, address string) string {
+	m.tb.Helper()
+	l, err := net.Listen(network, address)
+	if err != nil {
+		m.tb.Fatalf("tearpctest: listen: %v", err)
+	}
+	m.tb.Cleanup(func() { _ = l.Close() })
+	go m.server.Accept(l)
+	return l.Addr().String()
+}
+
+// 一个预期, 和参数、返回值的类型无关的部分
+type expectation struct {
+	method   string
+	match    func(args interface{}) bool
+	respond  func(ctx context.Context, args, reply interface{}) error
+	delay    time.Duration
+	times    int // 小于 0 表示不限次数
+	calls    int
+	describe string
+}
+
+// Expectation is one expected call of a method with arguments of type A
+// and a reply of type R. By default it matches any arguments, replies with
+// the zero R and is expected exactly once.
+type Expectation[A, R any] struct {
+	m *Mock
+	e *expectation
+}
+
+// On adds an expectation for serviceMethod. The first expectation of a
+// method registers it on the server; later ones must use the same types.
+func On[A, R any](m *Mock, serviceMethod string) *Expectation[A, R] {
+	m.tb.Helper()
+	types := [2]reflect.Type{reflect.TypeOf((*A)(nil)).Elem(), reflect.TypeOf((*R)(nil)).Elem()}
+	e := &expectation{method: serviceMethod, match: func(interface{}) bool { return true }, times: 1, describe: "any args"}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if registered, ok := m.types[serviceMethod]; ok {
+		if registered != types {
+			m.tb.Fatalf("tearpctest: %s is registered with (%s, *%s), not (%s, *%s)",
+				serviceMethod, registered[0], registered[1], types[0], types[1])
+		}
+	} else {
+		err := tearpc.RegisterTypedFunc(m.server, serviceMethod, func(ctx context.Context, args A, reply *R) error {
+			return m.handle(ctx, serviceMethod, args, reply)
+		})
+		if err != nil {
+			m.tb.Fatalf("tearpctest: register %s: %v", serviceMethod, err)
+		}
+		m.types[serviceMethod] = types
+	}
+	m.expects = append(m.expects, e)
+	return &Expectation[A, R]{m: m, e: e}
+}
+
+// WithArgs matches calls whose arguments are deeply equal to args.
+func (x *Expectation[A, R]) WithArgs(args A) *Expectation[A, R] {
+	return x.Matching(func(a A) bool { return reflect.DeepEqual(a, args) }, fmt.Sprintf("args %+v", args))
+}
+
+// Matching matches calls whose arguments satisfy match; desc describes them
+// in failure messages.
+func (x *Expectation[A, R]) Matching(match func(args A) bool, desc string) *Expectation[A, R] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+	x.e.match = func(args interface{}) bool { return match(args.(A)) }
+	x.e.describe = desc
+	return x
+}
+
+// Return replies with reply.
+func (x *Expectation[A, R]) Return(reply R) *Expectation[A, R] {
+	return x.Do(func(context.Context, A) (R, error) { return reply, nil })
+}
+
+// ReturnError fails the call with err; use tearpc.Errorf to choose the code.
+func (x *Expectation[A, R]) ReturnError(err error) *Expectation[A, R] {
+	return x.Do(func(context.Context, A) (R, error) {
+		var zero R
+		return zero, err
+	})
+}
+
+// Do computes the reply with fn.
+func (x *Expectation[A, R]) Do(fn func(ctx context.Context, args A) (R, error)) *Expectation[A, R] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+	x.e.respond = func(ctx context.Context, args, reply interface{}) error {
+		r, err := fn(ctx, args.(A))
+		if err != nil {
+			return err
+		}
+		*reply.(*R) = r
+		return nil
+	}
+	return x
+}
+
+// Delay waits d before replying, or until the call is canceled.
+func (x *Expectation[A, R]) Delay(d time.Duration) *Expectation[A, R] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+	x.e.delay = d
+	return x
+}
+
+// Times expects exactly n calls.
+func (x *Expectation[A, R]) Times(n int) *Expectation[A, R] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+	x.e.times = n
+	return x
+}
+
+// AnyTimes allows any number of calls, including none.
+func (x *Expectation[A, R]) AnyTimes() *Expectation[A, R] { return x.Times(-1) }
+
+// Calls returns how many calls the expectation has answered.
+func (x *Expectation[A, R]) Calls() int {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+	return x.e.calls
+}
+
+func (m *Mock) handle(ctx context.Context, method string, args, reply interface{}) error {
+	// 匹配函数是调用方写的, 可能很慢或者会用到 Mock 本身, 所以不能在持有锁的时候调用
+	type candidate struct {
+		e     *expectation
+		match func(interface{}) bool
+	}
+	m.mu.Lock()
+	var candidates []candidate
+	for _, c := range m.expects {
+		if c.method == method && (c.times < 0 || c.calls < c.times) {
+			candidates = append(candidates, candidate{c, c.match})
+		}
+	}
+	m.mu.Unlock()
+
+	var delay time.Duration
+	var respond func(ctx context.Context, args, reply interface{}) error
+	claimed := false
+	for _, c := range candidates {
+		if !c.match(args) {
+			continue
+		}
+		m.mu.Lock()
+		// 匹配期间次数可能被并发的调用用完了, 要重新检查
+		if e := c.e; e.times < 0 || e.calls < e.times {
+			e.calls++
+			delay, respond, claimed = e.delay, e.respond, true
+		}
+		m.mu.Unlock()
+		if claimed {
+			break
+		}
+	}
+	if !claimed {
+		m.tb.Errorf("tearpctest: unexpected call %s(%+v)", method, args)
+		return tearpc.Errorf(tearpc.Unimplemented, "tearpctest: unexpected call %s", method)
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if respond == nil {
+		return nil
+	}
+	return respond(ctx, args, reply)
+}
+
+// Verify reports every expectation that did not get its expected number
+// of calls. It runs when the test ends.
+func (m *Mock) Verify() {
+	m.tb.Helper()
+	if err := m.check(); err != nil {
+		m.tb.Error(err)
+	}
+}
+
+func (m *Mock) check() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var missing []string
+	for _, e := range m.expects {
+		if e.times >= 0 && e.calls != e.times {
+			missing = append(missing, fmt.Sprintf("%s with %s: expected %d calls, got %d", e.method, e.describe, e.times, e.calls))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("tearpctest: unmet expectations:\n\t%s", strings.Join(missing, "\n\t"))
+}
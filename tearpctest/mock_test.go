@@ -0,0 +1,107 @@
+package tearpctest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"tearpc"
+	"testing"
+	"time"
+)
+
+// failures 记录 Mock 报告的失败, 不让它们让测试本身失败
+type failures struct {
+	testing.TB
+	mu   sync.Mutex
+	errs []string
+}
+
+func (f *failures) Errorf(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = append(f.errs, fmt.Sprintf(format, args...))
+}
+
+func (f *failures) Error(args ...interface{}) { f.Errorf("%s", fmt.Sprint(args...)) }
+
+func (f *failures) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.errs...)
+}
+
+func TestMock(t *testing.T) {
+	mock := NewMock(t)
+	On[Args, int](mock, "Arith.Add").WithArgs(Args{Num1: 1, Num2: 2}).Return(3)
+	On[Args, int](mock, "Arith.Add").Matching(func(a Args) bool { return a.Num1 < 0 }, "negative Num1").
+		ReturnError(tearpc.Errorf(tearpc.InvalidArgument, "negative")).Times(2)
+	slow := On[Args, int](mock, "Arith.Slow").Delay(200 * time.Millisecond).AnyTimes()
+
+	client := mock.Client()
+	var sum int
+	if err := client.Call(context.Background(), "Arith.Add", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("Add = %d, %v", sum, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Call(context.Background(), "Arith.Add", Args{Num1: -1}, &sum); tearpc.CodeOf(err) != tearpc.InvalidArgument {
+			t.Fatalf("expect InvalidArgument, got %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Call(ctx, "Arith.Slow", Args{}, &sum); tearpc.CodeOf(err) != tearpc.DeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+	if slow.Calls() != 1 {
+		t.Fatalf("expect 1 call of Arith.Slow, got %d", slow.Calls())
+	}
+
+	// 通过普通的 Dial 连接
+	addr := mock.Listen("tcp", "127.0.0.1:0")
+	tcpClient, err := tearpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tcpClient.Close() }()
+	if err := tcpClient.Call(context.Background(), "Arith.Slow", Args{}, &sum); err != nil || sum != 0 {
+		t.Fatalf("Slow = %d, %v", sum, err)
+	}
+}
+
+func TestMockMatcherUsesMock(t *testing.T) {
+	mock := NewMock(t)
+	first := On[Args, int](mock, "Arith.Add").Return(1)
+	// 匹配函数里用到 Mock 本身不能死锁
+	On[Args, int](mock, "Arith.Add").Matching(func(Args) bool { return first.Calls() == 1 }, "after the first call").Return(2)
+
+	client := mock.Client()
+	for want := 1; want <= 2; want++ {
+		var sum int
+		if err := client.Call(context.Background(), "Arith.Add", Args{}, &sum); err != nil || sum != want {
+			t.Fatalf("Add = %d, %v, want %d", sum, err, want)
+		}
+	}
+}
+
+func TestMockFailures(t *testing.T) {
+	tb := &failures{TB: t}
+	mock := NewMock(tb)
+	On[Args, int](mock, "Arith.Add").WithArgs(Args{Num1: 1, Num2: 2}).Return(3).Times(2)
+	client := mock.Client()
+
+	var sum int
+	if err := client.Call(context.Background(), "Arith.Add", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("Add = %d, %v", sum, err)
+	}
+	err := client.Call(context.Background(), "Arith.Add", Args{Num1: 5}, &sum)
+	if tearpc.CodeOf(err) != tearpc.Unimplemented {
+		t.Fatalf("expect Unimplemented for an unexpected call, got %v", err)
+	}
+	mock.Verify()
+	errs := tb.list()
+	if len(errs) != 2 || !strings.Contains(errs[0], "unexpected call Arith.Add") ||
+		!strings.Contains(errs[1], "expected 2 calls, got 1") {
+		t.Fatalf("unexpected failures %q", errs)
+	}
+}
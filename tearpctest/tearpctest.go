@@ -0,0 +1,57 @@
+// Package tearpctest starts tearpc servers over in-memory pipes, so tests
+// need no ports, sockets or sleeps:
+//
+//	client := tearpctest.NewClient(t, &Foo{})
+//	err := client.Call(ctx, "Foo.Sum", args, &reply)
+//
+// Mock answers calls from expectations instead of a real service.
+// Everything started here is closed when the test ends.
+package tearpctest
+
+import (
+	"tearpc"
+	"testing"
+)
+
+// Serve serves s on a new in-memory listener until the test ends and
+// returns the listener. Dial it with Dial or tearpc.Dial("pipe", addr).
+func Serve(tb testing.TB, s *tearpc.Server) *tearpc.PipeListener {
+	tb.Helper()
+	l, err := tearpc.ListenPipe("")
+	if err != nil {
+		tb.Fatalf("tearpctest: listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return l
+}
+
+// Dial connects a client to l. The client is closed when the test ends.
+func Dial(tb testing.TB, l *tearpc.PipeListener, opts ...*tearpc.Option) *tearpc.Client {
+	tb.Helper()
+	client, err := tearpc.Dial(tearpc.PipeNetwork, l.Addr().String(), opts...)
+	if err != nil {
+		tb.Fatalf("tearpctest: dial %s: %v", l.Addr(), err)
+	}
+	tb.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// NewServer returns a server with rcvrs registered, as by Server.Register.
+func NewServer(tb testing.TB, rcvrs ...interface{}) *tearpc.Server {
+	tb.Helper()
+	s := tearpc.NewServer()
+	for _, rcvr := range rcvrs {
+		if err := s.Register(rcvr); err != nil {
+			tb.Fatalf("tearpctest: register %T: %v", rcvr, err)
+		}
+	}
+	return s
+}
+
+// NewClient registers rcvrs on a new server, serves it in memory and
+// returns a client connected to it.
+func NewClient(tb testing.TB, rcvrs ...interface{}) *tearpc.Client {
+	tb.Helper()
+	return Dial(tb, Serve(tb, NewServer(tb, rcvrs...)))
+}
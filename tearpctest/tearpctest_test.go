@@ -0,0 +1,38 @@
+package tearpctest
+
+import (
+	"context"
+	"tearpc"
+	"tearpc/codec"
+	"testing"
+)
+
+type Args struct{ Num1, Num2 int }
+
+type Arith struct{}
+
+func (Arith) Add(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func TestNewClient(t *testing.T) {
+	client := NewClient(t, Arith{})
+	var sum int
+	if err := client.Call(context.Background(), "Arith.Add", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("call failed: %d %v", sum, err)
+	}
+}
+
+func TestServeDial(t *testing.T) {
+	s := NewServer(t, Arith{})
+	l := Serve(t, s)
+	// 同一个服务可以连多个客户端, 各自用不同的编码
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType} {
+		client := Dial(t, l, &tearpc.Option{MagicNumber: tearpc.DefaultMagicNumber, CodecType: ct})
+		var sum int
+		if err := client.Call(context.Background(), "Arith.Add", Args{Num1: 2, Num2: 3}, &sum); err != nil || sum != 5 {
+			t.Fatalf("%s: call failed: %d %v", ct, sum, err)
+		}
+	}
+}
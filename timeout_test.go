@@ -0,0 +1,103 @@
+package tearpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Sleeper int
+
+func (s Sleeper) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (s Sleeper) Nap(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func TestServer_MethodTimeout(t *testing.T) {
+	s := NewServer()
+	var sl Sleeper
+	err := s.Register(&sl, WithTimeout(time.Second), WithMethodTimeout("Sleep", 50*time.Millisecond),
+		WithMethodCallTimeout("Nap", 50*time.Millisecond))
+	_assert(err == nil, "register failed: %v", err)
+	_assert(s.Register(&sl, WithMethodTimeout("Nope", time.Second)) != nil, "unknown method names must be rejected")
+
+	// 客户端要求的超时更长, 服务端声明的超时依然生效
+	client, done := dialTestServer(s, &Option{HandleTimeout: time.Minute})
+	defer done()
+	var reply int
+	err = client.Call(context.Background(), "Sleeper.Sleep", 200*time.Millisecond, &reply)
+	_assert(errors.Is(err, DeadlineExceeded) && strings.Contains(err.Error(), "handle timeout"),
+		"expect server handle timeout, got %v", err)
+
+	// 第一次调用之后客户端就知道了默认的调用超时
+	err = client.Call(context.Background(), "Sleeper.Nap", time.Duration(0), &reply)
+	_assert(err == nil, "nap failed: %v", err)
+	err = client.Call(context.Background(), "Sleeper.Nap", 200*time.Millisecond, &reply)
+	_assert(errors.Is(err, DeadlineExceeded) && strings.Contains(err.Error(), "rpc client"),
+		"expect client side call timeout, got %v", err)
+
+	w := httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "50ms"), "debug page should show the timeouts")
+}
+
+func TestClient_LoadCallTimeouts(t *testing.T) {
+	s := NewServer()
+	var sl Sleeper
+	_assert(s.Register(&sl, WithMethodCallTimeout("Nap", 50*time.Millisecond)) == nil, "register failed")
+
+	client, done := dialTestServer(s, &Option{LoadCallTimeouts: true})
+	defer done()
+	var timeouts map[string]time.Duration
+	err := client.Call(context.Background(), ReflectionService+".CallTimeouts", 0, &timeouts)
+	_assert(err == nil && len(timeouts) == 1 && timeouts["Sleeper.Nap"] == 50*time.Millisecond, "unexpected timeouts %v %v", timeouts, err)
+
+	// 连接时已经加载了默认超时, 第一次调用就生效
+	var reply int
+	err = client.Call(context.Background(), "Sleeper.Nap", 200*time.Millisecond, &reply)
+	_assert(errors.Is(err, DeadlineExceeded) && strings.Contains(err.Error(), "rpc client"),
+		"expect client side call timeout, got %v", err)
+
+	// Go 没有 ctx, 同样使用默认超时
+	call := <-client.Go("Sleeper.Nap", 200*time.Millisecond, &reply, nil).Done
+	_assert(errors.Is(call.Error, DeadlineExceeded), "expect Go to time out, got %v", call.Error)
+	call = <-client.Go("Sleeper.Sleep", 100*time.Millisecond, &reply, nil).Done
+	_assert(call.Error == nil, "methods without a default must not time out, got %v", call.Error)
+}
+
+func TestClient_LoadCallTimeoutsNoReply(t *testing.T) {
+	defer func(d time.Duration) { loadCallTimeoutsTimeout = d }(loadCallTimeoutsTimeout)
+	loadCallTimeoutsTimeout = 50 * time.Millisecond
+
+	// 对端读走所有数据, 但是从来不回复
+	conn, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	opt := *DefaultOption
+	opt.LoadCallTimeouts, opt.ConnectTimeout = true, 0 // 没有 ConnectTimeout 时也有上限
+	ch := make(chan error, 1)
+	go func() {
+		client, err := NewClient(conn, &opt)
+		if err == nil {
+			_ = client.Close()
+		}
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		_assert(err == nil, "a server that never replies must not fail NewClient, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("loading call timeouts hung NewClient")
+	}
+}
@@ -0,0 +1,88 @@
+package tearpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type Whoami int
+
+func (w Whoami) Name(ctx context.Context, _ int, reply *string) error {
+	p, ok := PeerFromContext(ctx)
+	if !ok {
+		return Errorf(Internal, "no peer in context")
+	}
+	*reply = p.Identity
+	return nil
+}
+
+// 签发一张证书, parent 为空时生成自签名的 CA
+func issueCert(cn string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	_assert(err == nil, "create certificate: %v", err)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := issueCert("test ca", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := issueCert("server", &ca, false)
+	clientCert := issueCert("client-a", &ca, false)
+
+	s := NewServer()
+	var w Whoami
+	_ = s.Register(&w)
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+
+	client, err := XDial("tls@"+l.Addr().String(), &Option{
+		ConnectTimeout: time.Second,
+		TLSConfig:      &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}},
+	})
+	_assert(err == nil, "tls dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var name string
+	err = client.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(err == nil && name == "client-a", "expect identity client-a, got %q, %v", name, err)
+
+	// 没有客户端证书, 握手失败
+	noCert, err := DialTLS("tcp", l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err == nil {
+		err = noCert.Call(context.Background(), "Whoami.Name", 0, &name)
+		_ = noCert.Close()
+	}
+	_assert(err != nil, "expect the call without client certificate to fail")
+}
@@ -0,0 +1,196 @@
+package tearpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+调用链追踪
+1、客户端: Option.SpanExporter 不为空, 或者 ctx 里已经有 span(比如在服务端的方法里继续调用下游), 每次调用都会开始一个客户端 span,
+   trace id 和 span id 放在 Header 里发给服务端
+2、服务端: Server.SpanExporter 不为空, 或者请求带了 trace id, handleRequest 开始一个服务端 span, 父节点是客户端的 span.
+   方法拿到的 ctx 里带着这个 span, 用它发起的调用会成为它的子节点
+3、span 结束时交给 SpanExporter, 只有配置了 SpanExporter 的一端会导出, 另一端只负责传递 id
+*/
+
+type SpanKind string
+
+const (
+	SpanClient SpanKind = "client"
+	SpanServer SpanKind = "server"
+)
+
+// Span records one call, as seen by the client or by the server.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string `json:",omitempty"`
+	Name     string // "Service.Method"
+	Kind     SpanKind
+	Peer     string // 对端的地址
+	Start    time.Time
+	End      time.Time
+	Code     Code
+	Error    string `json:",omitempty"`
+	// 请求和响应在连接上占的字节数(header + body), 不知道时为 0
+	RequestSize  int64
+	ResponseSize int64
+}
+
+func (s *Span) Duration() time.Duration { return s.End.Sub(s.Start) }
+
+// SpanExporter receives every finished span. It is called from the
+// goroutines serving calls, so it must be safe for concurrent use and
+// should not block.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+func (sc SpanContext) valid() bool { return sc.TraceID != "" && sc.SpanID != "" }
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a context whose calls become children of
+// sc, e.g. to continue a trace started by another system.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span of the call being handled.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.valid()
+}
+
+func newTraceID() string { return randomID(16) }
+
+func newSpanID() string { return randomID(8) }
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan 开始一个 span, 父节点是 parent; parent 无效时开始一个新的调用链
+func startSpan(kind SpanKind, name, peer string, parent SpanContext) *Span {
+	span := &Span{SpanID: newSpanID(), Name: name, Kind: kind, Peer: peer, Start: time.Now()}
+	if parent.valid() {
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		span.TraceID = newTraceID()
+	}
+	return span
+}
+
+func (s *Span) context() SpanContext { return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID} }
+
+// finish 结束 span 并导出, exporter 为空时只是丢弃
+func (s *Span) finish(exporter SpanExporter, err error) {
+	s.End = time.Now()
+	s.Code = CodeOf(err)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if exporter != nil {
+		exporter.ExportSpan(s)
+	}
+}
+
+// MemoryExporter keeps finished spans in memory, for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func NewMemoryExporter() *MemoryExporter { return &MemoryExporter{} }
+
+func (e *MemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, *span)
+}
+
+// Spans returns a copy of the spans exported so far, in export order.
+func (e *MemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// JSONExporter writes each span as one line of JSON.
+type JSONExporter struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// NewJSONFileExporter appends spans to the file at path, creating it if
+// needed. Close the exporter to close the file.
+func NewJSONFileExporter(path string) (*JSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONExporter(f)
+	e.closer = f
+	return e, nil
+}
+
+func (e *JSONExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(span)
+}
+
+func (e *JSONExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// 服务端的 span: 请求带了 trace id 就接着这个调用链, 否则只有配置了 SpanExporter 才开始新的调用链
+func (s *Server) startSpan(req *request) *Span {
+	parent := SpanContext{TraceID: req.Header.TraceID, SpanID: req.Header.SpanID}
+	if s.SpanExporter == nil && !parent.valid() {
+		return nil
+	}
+	peer := ""
+	if p, ok := PeerFromContext(req.ctx); ok && p.Addr != nil {
+		peer = p.Addr.String()
+	}
+	return startSpan(SpanServer, req.Header.ServerMethod, peer, parent)
+}
+
+// 客户端的 span: ctx 里有 span 就作为它的子节点, 否则只有配置了 SpanExporter 才开始新的调用链
+func (c *Client) startSpan(ctx context.Context, serviceMethod string) *Span {
+	parent, ok := SpanContextFromContext(ctx)
+	if c.opt.SpanExporter == nil && !ok {
+		return nil
+	}
+	return startSpan(SpanClient, serviceMethod, c.addr, parent)
+}
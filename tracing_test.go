@@ -0,0 +1,91 @@
+package tearpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Frontend 把请求转发给后端的 Foo.Sum
+type Frontend struct {
+	backend *Client
+}
+
+func (f *Frontend) Sum(ctx context.Context, args Args, reply *int) error {
+	return f.backend.Call(ctx, "Foo.Sum", args, reply)
+}
+
+func TestTracing(t *testing.T) {
+	mem := NewMemoryExporter()
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	file, err := NewJSONFileExporter(path)
+	_assert(err == nil, "open exporter: %v", err)
+	defer func() { _ = file.Close() }()
+
+	backend := NewServer()
+	var foo Foo
+	_ = backend.Register(&foo)
+	backend.SpanExporter = file
+	opt := *DefaultOption
+	opt.SpanExporter = mem
+	backendClient, cleanup := dialTestServer(backend, &opt)
+	defer cleanup()
+
+	frontend := NewServer()
+	_ = frontend.Register(&Frontend{backend: backendClient})
+	frontend.SpanExporter = mem
+	client, cleanup2 := dialTestServer(frontend, &opt)
+	defer cleanup2()
+
+	var reply int
+	err = client.Call(context.Background(), "Frontend.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "call failed: %d %v", reply, err)
+
+	// 下游的客户端 span, 前端的服务端 span, 最外层的客户端 span; 导出的顺序不确定
+	spans := mem.Spans()
+	_assert(len(spans) == 3, "expect 3 spans, got %+v", spans)
+	var inner, server, outer Span
+	for _, s := range spans {
+		switch {
+		case s.Kind == SpanServer:
+			server = s
+		case s.Name == "Foo.Sum":
+			inner = s
+		default:
+			outer = s
+		}
+	}
+	_assert(outer.Kind == SpanClient && outer.Name == "Frontend.Sum" && outer.ParentID == "", "unexpected root span %+v", outer)
+	_assert(server.Kind == SpanServer && server.ParentID == outer.SpanID, "unexpected server span %+v", server)
+	_assert(inner.Kind == SpanClient && inner.Name == "Foo.Sum" && inner.ParentID == server.SpanID, "unexpected inner span %+v", inner)
+	for _, s := range spans {
+		_assert(s.TraceID == outer.TraceID, "spans belong to different traces: %+v", spans)
+		_assert(s.Code == OK && s.RequestSize > 0 && s.ResponseSize > 0 && s.Peer != "", "unexpected span %+v", s)
+		_assert(!s.End.Before(s.Start), "span ends before it starts: %+v", s)
+	}
+	_assert(outer.RequestSize == server.RequestSize && outer.ResponseSize == server.ResponseSize,
+		"client and server disagree on sizes: %+v %+v", outer, server)
+
+	// 后端的服务端 span 写在文件里
+	f, err := os.Open(path)
+	_assert(err == nil, "open spans: %v", err)
+	defer func() { _ = f.Close() }()
+	var backendSpans []Span
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s Span
+		_assert(json.Unmarshal(sc.Bytes(), &s) == nil, "bad line %q", sc.Text())
+		backendSpans = append(backendSpans, s)
+	}
+	_assert(len(backendSpans) == 1 && backendSpans[0].ParentID == inner.SpanID && backendSpans[0].TraceID == outer.TraceID,
+		"unexpected backend spans %+v", backendSpans)
+
+	// 错误的状态码也会记录下来
+	mem.Reset()
+	err = client.Call(context.Background(), "Frontend.Nope", Args{}, &reply)
+	spans = mem.Spans()
+	_assert(len(spans) == 1 && spans[0].Code == NotFound && spans[0].Error == err.Error(), "unexpected spans %+v", spans)
+}
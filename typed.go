@@ -0,0 +1,51 @@
+package tearpc
+
+import "context"
+
+/*
+泛型的调用封装, 不用再自己分配 reply 和做类型断言:
+
+	sum, err := tearpc.Invoke[Args, int](ctx, client, "Foo.Sum", Args{1, 2})
+
+	f := tearpc.InvokeAsync[Args, int](ctx, client, "Foo.Sum", Args{1, 2})
+	...
+	sum, err := f.Wait()
+*/
+
+// Invoke calls serviceMethod with req and returns the decoded reply.
+func Invoke[Req any, Resp any](ctx context.Context, client *Client, serviceMethod string, req Req) (Resp, error) {
+	var reply Resp
+	err := client.Call(ctx, serviceMethod, req, &reply)
+	return reply, err
+}
+
+// Future is the pending result of an InvokeAsync.
+type Future[Resp any] struct {
+	done  chan struct{}
+	call  *Call
+	reply Resp
+}
+
+// InvokeAsync starts calling serviceMethod and returns at once. Like Invoke
+// it honours the deadline, cancellation and metadata of ctx.
+func InvokeAsync[Req any, Resp any](ctx context.Context, client *Client, serviceMethod string, req Req) *Future[Resp] {
+	f := &Future[Resp]{done: make(chan struct{})}
+	ctx, cancel := client.withCallTimeout(ctx, serviceMethod)
+	// 和 Go 一样只是把请求发出去, 不为每个调用启动 goroutine. 完成时由 call.done 通知 Future
+	call := client.newCall(ctx, serviceMethod, req, &f.reply, make(chan *Call, 1))
+	f.call = client.sendContext(ctx, call, func() {
+		cancel()
+		close(f.done)
+	})
+	return f
+}
+
+// Done is closed when the call has completed.
+func (f *Future[Resp]) Done() <-chan struct{} { return f.done }
+
+// Wait blocks until the call has completed and returns its result. It may
+// be called any number of times.
+func (f *Future[Resp]) Wait() (Resp, error) {
+	<-f.done
+	return f.reply, f.call.Error
+}
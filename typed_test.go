@@ -0,0 +1,39 @@
+package tearpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInvoke(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	var sl Sleeper
+	_ = s.Register(&foo)
+	_ = s.Register(&sl)
+	client, cleanup := dialTestServer(s)
+	defer cleanup()
+
+	sum, err := Invoke[Args, int](context.Background(), client, "Foo.Sum", Args{Num1: 1, Num2: 2})
+	_assert(err == nil && sum == 3, "Invoke: %d, %v", sum, err)
+
+	_, err = Invoke[Args, string](context.Background(), client, "Foo.Nope", Args{})
+	_assert(CodeOf(err) == NotFound, "expect NotFound, got %v", err)
+
+	futures := make([]*Future[int], 10)
+	for i := range futures {
+		futures[i] = InvokeAsync[Args, int](context.Background(), client, "Foo.Sum", Args{Num1: i, Num2: i})
+	}
+	for i, f := range futures {
+		<-f.Done()
+		sum, err := f.Wait()
+		_assert(err == nil && sum == 2*i, "future %d: %d, %v", i, sum, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	f := InvokeAsync[time.Duration, int](ctx, client, "Sleeper.Sleep", time.Second)
+	_, err = f.Wait()
+	_assert(CodeOf(err) == DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+}